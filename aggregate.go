@@ -0,0 +1,206 @@
+package xlsxt
+
+import (
+    "fmt"
+    "errors"
+    "regexp"
+    "reflect"
+    "strings"
+    "strconv"
+    "github.com/tealeg/xlsx"
+)
+
+var (
+    // {{sum Items.Amount}}, {{count Items where="Amount > 0"}}
+    rxAggregate = regexp.MustCompile(`\{\{\s*(sum|avg|min|max|count)\s+([\w\.]+)((?:\s+\w+\s*=\s*(?:"[^"]*"|'[^']*'|[^\s\}]+))*)\s*\}\}`)
+    // errOneShot - однократный источник нельзя прочитать для агрегата и еще раз для цикла
+    errOneShot = errors.New("One-shot source (channel, iterator, *sql.Rows) can not be read twice")
+)
+
+// renderAggregates - вычисление агрегатов в ячейках строки
+func renderAggregates(row *xlsx.Row, sc *scope) error {
+    for _, cell := range row.Cells {
+        if cell != nil {
+            if err := renderAggregateCell(cell, sc); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// renderAggregateCell - вычисление агрегатов в ячейке
+// Если ячейка состоит только из агрегата, то значение записывается числом
+func renderAggregateCell(cell *xlsx.Cell, sc *scope) error {
+    if !rxAggregate.MatchString(cell.Value) {
+        return nil
+    }
+    var err error
+    if match := rxAggregate.FindString(cell.Value); match == strings.TrimSpace(cell.Value) {
+        var result interface{}
+        if result, err = evalAggregate(match, sc); err != nil {
+            return err
+        }
+        if result == nil {
+            cell.Value = ""
+        } else {
+            setCellNumber(cell, result)
+        }
+        return nil
+    }
+    cell.Value = rxAggregate.ReplaceAllStringFunc(cell.Value, func(expr string) string {
+        if err != nil {
+            return ""
+        }
+        var result interface{}
+        if result, err = evalAggregate(expr, sc); err != nil || result == nil {
+            return ""
+        }
+        return formatNumber(result)
+    })
+    return err
+}
+
+// evalAggregate - вычисление выражения агрегата
+// Путь считается от ближайшей области видимости (внутри группы - по элементам группы).
+// Агрегат по однократному источнику (каналу, итератору, *sql.Rows) - ошибка
+func evalAggregate(expr string, sc *scope) (interface{}, error) {
+    match := rxAggregate.FindStringSubmatch(expr)
+    if match == nil {
+        return nil, fmt.Errorf("Invalid aggregate: %s", expr)
+    }
+    args := parseHashArgs(match[3])
+    f, err := parseFilter(args["where"])
+    if err != nil {
+        return nil, err
+    }
+    var values []interface{}
+    if sc, rest := sc.lookup(strings.Split(match[2], ".")); sc != nil {
+        if err := collectValues(sc.items, reflect.Value{}, rest, f, false, &values); err != nil {
+            return nil, fmt.Errorf("%s: %s", err.Error(), expr)
+        }
+    }
+    return aggregate(match[1], values), nil
+}
+
+// collectValues - собираем значения по пути, раскрывая массивы и срезы
+// Фильтр применяется к ближайшему элементу коллекции (owner).
+// Однократные источники читаются только при once (единственное чтение), иначе - ошибка errOneShot
+func collectValues(v, owner reflect.Value, path []string, f *filter, once bool, out *[]interface{}) error {
+    if it, oneShot := streamSource(v); it != nil {
+        if oneShot && !once {
+            return errOneShot
+        }
+        defer closeIterator(it)
+        for it.Next() {
+            item := reflect.ValueOf(it.Value())
+            if err := collectValues(item, item, path, f, once, out); err != nil {
+                return err
+            }
+        }
+        return iteratorErr(it)
+    }
+    v = indirect(v)
+    if !v.IsValid() {
+        return nil
+    }
+    if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+        for i := 0; i < v.Len(); i++ {
+            if err := collectValues(v.Index(i), v.Index(i), path, f, once, out); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    if ds, ok := asDataSource(v); ok && len(path) > 0 {
+        if it := ds.Iterate(path[0]); it != nil {
+            defer closeIterator(it)
+            for it.Next() {
+                item := reflect.ValueOf(it.Value())
+                if err := collectValues(item, item, path[1:], f, once, out); err != nil {
+                    return err
+                }
+            }
+            return iteratorErr(it)
+        }
+    }
+    if len(path) < 1 {
+        if !owner.IsValid() || f.match(owner) {
+            *out = append(*out, v.Interface())
+        }
+        return nil
+    }
+    if fv, ok := findValue(v, path[0]); ok {
+        return collectValues(fv, owner, path[1:], f, once, out)
+    }
+    return nil
+}
+
+// aggregate - вычисление агрегатной функции
+// sum/min/max над целыми возвращают int64, avg - float64, count - int
+// Для пустого набора avg/min/max возвращают nil
+func aggregate(fn string, values []interface{}) interface{} {
+    if fn == "count" {
+        return len(values)
+    }
+    var (
+        numbers []float64
+        integer = true
+    )
+    for _, value := range values {
+        if n, ok := toFloat(value); ok {
+            numbers = append(numbers, n)
+            integer = integer && isInteger(value)
+        }
+    }
+    if len(numbers) < 1 {
+        if fn == "sum" {
+            return int64(0)
+        }
+        return nil
+    }
+    result := numbers[0]
+    switch fn {
+    case "sum", "avg":
+        result = 0.0
+        for _, n := range numbers {
+            result += n
+        }
+        if fn == "avg" {
+            return result / float64(len(numbers))
+        }
+    case "min":
+        for _, n := range numbers[1:] {
+            if n < result {
+                result = n
+            }
+        }
+    case "max":
+        for _, n := range numbers[1:] {
+            if n > result {
+                result = n
+            }
+        }
+    }
+    if integer {
+        return int64(result)
+    }
+    return result
+}
+
+// setCellNumber - запись числа в ячейку с сохранением формата шаблона
+func setCellNumber(cell *xlsx.Cell, value interface{}) {
+    numFmt := cell.NumFmt
+    cell.SetValue(value)
+    if len(numFmt) > 0 {
+        cell.NumFmt = numFmt
+    }
+}
+
+// formatNumber - число в строку без экспоненты
+func formatNumber(value interface{}) string {
+    if f, ok := value.(float64); ok {
+        return strconv.FormatFloat(f, 'f', -1, 64)
+    }
+    return fmt.Sprint(value)
+}
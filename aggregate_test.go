@@ -0,0 +1,69 @@
+package xlsxt
+
+import (
+    "testing"
+    "github.com/tealeg/xlsx"
+)
+
+type aggregateItem struct {
+    Name   string
+    Amount float64
+    Qty    int
+}
+
+type aggregateDoc struct {
+    Title string
+    Items []aggregateItem
+}
+
+var aggregateData = &aggregateDoc{Title: "T", Items: []aggregateItem{{"a", 10.5, 1}, {"b", 20, 2}, {"c", 30, 3}}}
+
+func TestAggregates(t *testing.T) {
+    values := renderTestValues(t, [][]string{
+        {"{{sum Items.Amount}}", "{{sum Items.Qty}}", "{{count Items}}", "{{avg Items.Qty}}", "{{min Items.Amount}}", "{{max Items.Qty}}"},
+    }, aggregateData)
+    checkValues(t, values, [][]string{{"60.5", "6", "3", "2", "10.5", "3"}})
+}
+
+func TestAggregateWhere(t *testing.T) {
+    values := renderTestValues(t, [][]string{
+        {`{{count Items where="Amount > 10"}}`, `{{sum Items.Qty where="Amount > 10 && Name != 'b'"}}`, `{{avg Items.Amount where="Amount > 1000"}}`},
+    }, aggregateData)
+    // Агрегат без значений - пустая ячейка
+    checkValues(t, values, [][]string{{"3", "4", ""}})
+}
+
+func TestAggregateInText(t *testing.T) {
+    values := renderTestValues(t, [][]string{
+        {"{{Title}}: {{sum Items.Amount}} ({{count Items}})"},
+    }, aggregateData)
+    checkValues(t, values, [][]string{{"T: 60.5 (3)"}})
+}
+
+func TestAggregateCellIsNumber(t *testing.T) {
+    tpl := newTestTemplate([][]string{{"{{sum Items.Amount}}", "Total {{sum Items.Amount}}"}})
+    tpl.template.Sheets[0].Rows[0].Cells[0].NumFmt = "0.00"
+    if err := tpl.RenderTemplate(aggregateData); err != nil {
+        t.Fatal(err)
+    }
+    cells := tpl.result.Sheets[0].Rows[0].Cells
+    // Ячейка только с агрегатом - число в формате шаблона, агрегат в тексте - текст
+    if cells[0].Type() != xlsx.CellTypeNumeric || cells[0].NumFmt != "0.00" {
+        t.Errorf("sum: %q type %v format %q", cells[0].Value, cells[0].Type(), cells[0].NumFmt)
+    }
+    if value, _ := cells[0].FormattedValue(); value != "60.50" {
+        t.Errorf("sum: %q", value)
+    }
+    if cells[1].Type() == xlsx.CellTypeNumeric || cells[1].Value != "Total 60.5" {
+        t.Errorf("text: %q type %v", cells[1].Value, cells[1].Type())
+    }
+}
+
+func TestAggregateRowsNextToItems(t *testing.T) {
+    // Строка с агрегатом не повторяется для элементов коллекции
+    values := renderTestValues(t, [][]string{
+        {"{{Items.Name}}", "{{Items.Qty}}"},
+        {"Total", "{{sum Items.Qty}}"},
+    }, aggregateData)
+    checkValues(t, values, [][]string{{"a", "1"}, {"b", "2"}, {"c", "3"}, {"Total", "6"}})
+}
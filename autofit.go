@@ -0,0 +1,217 @@
+package xlsxt
+
+import (
+    "strings"
+    "unicode/utf8"
+    "github.com/tealeg/xlsx"
+    "github.com/legion-zver/gopdf"
+)
+
+const (
+    autoFitLineSpacing = 1.3 // высота строки текста относительно размера шрифта
+    autoFitDigitWidth  = 7.0 // ширина символа колонки Excel (px)
+    autoFitPadding     = 5.0 // отступы текста в колонке (px)
+    autoFitFontSize    = 11  // размер шрифта без стиля
+    maxRowHeight       = 409 // максимальная высота строки xlsx (pt)
+)
+
+// SetAutoFit (XlsxTemplateFile) - подбор высоты строк с переносом текста и ширины колонок,
+// отмеченных [auto-width], по тексту результата (шрифты из SetFontDir)
+func (s *XlsxTemplateFile) SetAutoFit(enabled bool) {
+    s.autoFit = enabled
+}
+
+// textMeter - измерение ширины текста шрифтами TTF из каталога шрифтов
+// Без файла шрифта ширина оценивается по количеству символов
+type textMeter struct {
+    pdf     *gopdf.GoPdf
+    fontDir string
+    fonts   map[string]bool // загруженные шрифты (false - файла шрифта нет)
+}
+
+// newTextMeter - измеритель текста для каталога шрифтов
+func newTextMeter(fontDir string) *textMeter {
+    pdf := &gopdf.GoPdf{}
+    pdf.Start(gopdf.Config{Unit: "pt", PageSize: gopdf.Rect{W: 595.28, H: 841.89}})
+    return &textMeter{pdf: pdf, fontDir: fontDir, fonts: make(map[string]bool)}
+}
+
+// width (textMeter) - ширина текста шрифтом font (pt)
+func (m *textMeter) width(font xlsx.Font, text string) float64 {
+    size := fontSize(font)
+    style := runStyle(nil, font)
+    name := toPdfFont(style)
+    loaded, ok := m.fonts[name]
+    if !ok {
+        loaded = len(m.fontDir) > 0 && m.pdf.AddTTFFont(name, m.fontDir+"/"+name+".ttf") == nil
+        m.fonts[name] = loaded
+    }
+    if loaded && m.pdf.SetFont(name, getPdfFontStyleFromXLSXStyle(style), size) == nil {
+        if w, err := m.pdf.MeasureTextWidth(text); err == nil {
+            return w
+        }
+    }
+    return float64(utf8.RuneCountInString(text)*size) * 0.55
+}
+
+// fontSize - размер шрифта (по умолчанию autoFitFontSize)
+func fontSize(font xlsx.Font) int {
+    if font.Size > 0 {
+        return font.Size
+    }
+    return autoFitFontSize
+}
+
+// autoWidthColumns - колонки вкладки шаблона с меткой [auto-width] в какой-либо ячейке
+func autoWidthColumns(sheet *xlsx.Sheet) map[int]bool {
+    columns := make(map[int]bool)
+    for _, row := range sheet.Rows {
+        for i, cell := range row.Cells {
+            if cell != nil && rxAutoWidth.MatchString(cell.Value) {
+                columns[i] = true
+            }
+        }
+    }
+    return columns
+}
+
+// autoFitSheet - подбор высоты строк с переносом текста и ширины колонок columns по тексту ячеек
+// Строки и колонки только увеличиваются, ячейки объединений по вертикали высоту не меняют
+func autoFitSheet(sheet *xlsx.Sheet, columns map[int]bool, rich richText, meter *textMeter) {
+    // Ширина колонок берется и меняется по номеру колонки
+    splitCols(sheet)
+    widths := make(map[int]float64)
+    for _, row := range sheet.Rows {
+        height := 0.0
+        for i, cell := range row.Cells {
+            if cell == nil || cell.Hidden || len(cell.Value) < 1 {
+                continue
+            }
+            _, runs := cellRichText(cell, rich)
+            if runs == nil {
+                runs = []textRun{{Text: cellText(cell), Font: cellFont(cell)}}
+            }
+            paragraphs := splitRuns(runs)
+            if columns[i] && cell.HMerge < 1 {
+                for _, line := range paragraphs {
+                    if w := runsWidth(line, meter); w > widths[i] {
+                        widths[i] = w
+                    }
+                }
+            }
+            style := cell.GetStyle()
+            if style == nil || !style.Alignment.WrapText || cell.VMerge > 0 {
+                continue
+            }
+            width := 0.0
+            for c := i; c <= i+cell.HMerge && c < len(sheet.Cols); c++ {
+                width += columnPoints(sheet.Cols[c].Width)
+            }
+            h := 0.0
+            for _, paragraph := range paragraphs {
+                for _, line := range wrapRuns(paragraph, width, meter.width) {
+                    h += lineHeight(line)
+                }
+            }
+            if h > height {
+                height = h
+            }
+        }
+        if height > maxRowHeight {
+            height = maxRowHeight
+        }
+        if height > row.Height {
+            row.SetHeight(height)
+        }
+    }
+    for i, w := range widths {
+        for len(sheet.Cols) <= i {
+            sheet.Cols = append(sheet.Cols, &xlsx.Col{Min: len(sheet.Cols)+1, Max: len(sheet.Cols)+1})
+        }
+        col := sheet.Cols[i]
+        if width := (w/0.75+autoFitPadding)/autoFitDigitWidth + 1; width > col.Width {
+            col.Width = width
+        }
+    }
+}
+
+// splitCols - отдельная колонка на каждый элемент Cols: диапазоны Min-Max разбиваются на колонки
+// с той же шириной и стилем, чтобы ширина одной колонки не меняла остальные колонки диапазона.
+// Если колонка описана несколько раз (колонки шаблона и добавленные при записи ячеек),
+// остается первое описание
+func splitCols(sheet *xlsx.Sheet) {
+    var cols []*xlsx.Col
+    defined := make(map[int]bool)
+    for i, col := range sheet.Cols {
+        if col == nil {
+            continue
+        }
+        min, max := col.Min, col.Max
+        if min < 1 || max < min {
+            min, max = i+1, i+1
+        }
+        for c := min; c <= max; c++ {
+            for len(cols) < c {
+                cols = append(cols, &xlsx.Col{Min: len(cols)+1, Max: len(cols)+1})
+            }
+            if defined[c] {
+                continue
+            }
+            defined[c] = true
+            split := *col
+            split.Min, split.Max = c, c
+            cols[c-1] = &split
+        }
+    }
+    sheet.Cols = cols
+}
+
+// splitRuns - фрагменты по абзацам (переводам строк)
+func splitRuns(runs []textRun) [][]textRun {
+    paragraphs := [][]textRun{nil}
+    for _, run := range runs {
+        for i, text := range strings.Split(run.Text, "\n") {
+            if i > 0 {
+                paragraphs = append(paragraphs, nil)
+            }
+            n := len(paragraphs)-1
+            paragraphs[n] = append(paragraphs[n], textRun{Text: text, Font: run.Font})
+        }
+    }
+    return paragraphs
+}
+
+// runsWidth - ширина строки фрагментов (pt)
+func runsWidth(line []textRun, meter *textMeter) float64 {
+    width := 0.0
+    for _, run := range line {
+        width += meter.width(run.Font, run.Text)
+    }
+    return width
+}
+
+// lineHeight - высота строки фрагментов по самому крупному шрифту (pt)
+func lineHeight(line []textRun) float64 {
+    size := 0
+    for _, run := range line {
+        if s := fontSize(run.Font); s > size {
+            size = s
+        }
+    }
+    if size < 1 {
+        size = autoFitFontSize
+    }
+    return float64(size) * autoFitLineSpacing
+}
+
+// columnPoints - ширина текста в колонке шириной width (символов) в pt
+func columnPoints(width float64) float64 {
+    if width <= 0 {
+        width = xlsx.ColWidth
+    }
+    px := width*autoFitDigitWidth - autoFitPadding
+    if px < autoFitDigitWidth {
+        px = autoFitDigitWidth
+    }
+    return px * 0.75
+}
@@ -0,0 +1,78 @@
+package xlsxt
+
+import (
+    "strings"
+    "testing"
+    "github.com/tealeg/xlsx"
+)
+
+type fitItem struct{ Name, Desc string }
+
+func TestAutoFit(t *testing.T) {
+    tpl := newTestTemplate([][]string{{"Name[auto-width]", "Desc"}, {"{{Items.Name}}", "{{Items.Desc}}"}})
+    for c := 0; c < 2; c++ {
+        tpl.template.Sheets[0].Col(c).Width = 10
+    }
+    style := xlsx.NewStyle()
+    style.Alignment.WrapText = true
+    style.Font.Size = 10
+    tpl.template.Sheets[0].Rows[1].Cells[1].SetStyle(style)
+    tpl.SetAutoFit(true)
+    data := struct{ Items []fitItem }{[]fitItem{
+        {"short", "x"},
+        {"a very very long product name here", strings.Repeat("word ", 30)},
+        {"b", "line1\nline2\nline3"},
+    }}
+    if err := tpl.RenderTemplate(data); err != nil {
+        t.Fatal(err)
+    }
+    sheet := tpl.result.Sheets[0]
+    // Метка [auto-width] убирается, колонка без метки ширину не меняет
+    if sheet.Rows[0].Cells[0].Value != "Name" {
+        t.Errorf("value: %q", sheet.Rows[0].Cells[0].Value)
+    }
+    if width := sheet.Col(0).Width; width <= 10 {
+        t.Errorf("auto width: %v", width)
+    }
+    if width := sheet.Col(1).Width; width != 10 {
+        t.Errorf("width: %v", width)
+    }
+    // Высота строк с переносом - по числу строк текста
+    if sheet.Rows[2].Height <= sheet.Rows[1].Height || sheet.Rows[3].Height < 3*10 {
+        t.Errorf("heights: %v %v %v", sheet.Rows[1].Height, sheet.Rows[2].Height, sheet.Rows[3].Height)
+    }
+}
+
+func TestAutoFitSplitsColumnRange(t *testing.T) {
+    // Ширина колонки из общего диапазона не меняет остальные колонки диапазона
+    tpl := newTestTemplate([][]string{{"{{A}}[auto-width]", "b", "c"}})
+    tpl.template.Sheets[0].Cols = []*xlsx.Col{{Min: 1, Max: 3, Width: 20}}
+    tpl.SetAutoFit(true)
+    if err := tpl.RenderTemplate(map[string]interface{}{"A": strings.Repeat("long text ", 10)}); err != nil {
+        t.Fatal(err)
+    }
+    cols := tpl.result.Sheets[0].Cols
+    if len(cols) < 3 || cols[0].Min != 1 || cols[0].Max != 1 || cols[0].Width <= 20 {
+        t.Fatalf("cols: %+v", cols)
+    }
+    for _, col := range cols[1:3] {
+        if col.Min != col.Max || col.Width != 20 {
+            t.Errorf("col %d-%d: %v", col.Min, col.Max, col.Width)
+        }
+    }
+    // Шаблон не меняется
+    if col := tpl.template.Sheets[0].Cols[0]; col.Min != 1 || col.Max != 3 || col.Width != 20 {
+        t.Errorf("template col: %+v", col)
+    }
+}
+
+func TestAutoFitDisabled(t *testing.T) {
+    tpl := newTestTemplate([][]string{{"{{A}}[auto-width]"}})
+    tpl.template.Sheets[0].Col(0).Width = 10
+    if err := tpl.RenderTemplate(map[string]interface{}{"A": strings.Repeat("long text ", 10)}); err != nil {
+        t.Fatal(err)
+    }
+    if width := tpl.result.Sheets[0].Col(0).Width; width != 10 {
+        t.Errorf("width: %v", width)
+    }
+}
@@ -0,0 +1,189 @@
+package xlsxt
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "sort"
+    "sync"
+    "context"
+    "runtime"
+    "strings"
+    "archive/zip"
+    "path/filepath"
+)
+
+// BatchSink - получатель результатов пакетного рендера
+// Put может вызываться одновременно из нескольких потоков
+type BatchSink interface {
+    Put(name string, file *XlsxTemplateFile) error
+}
+
+// SinkFunc - получатель результатов в виде функции
+type SinkFunc func(name string, file *XlsxTemplateFile) error
+
+// Put (SinkFunc)
+func (f SinkFunc) Put(name string, file *XlsxTemplateFile) error {
+    return f(name, file)
+}
+
+// DirSink - запись результатов в каталог (<name>.xlsx)
+func DirSink(dir string) BatchSink {
+    return SinkFunc(func(name string, file *XlsxTemplateFile) error {
+        return file.Save(filepath.Join(dir, batchFileName(name)))
+    })
+}
+
+// ZipSink - запись результатов в zip архив (<name>.xlsx), после рендера архив нужно закрыть (Close)
+type ZipSink struct {
+    mu     sync.Mutex
+    writer *zip.Writer
+}
+
+// NewZipSink - zip архив с результатами в writer
+func NewZipSink(writer io.Writer) *ZipSink {
+    return &ZipSink{writer: zip.NewWriter(writer)}
+}
+
+// Put (ZipSink)
+func (z *ZipSink) Put(name string, file *XlsxTemplateFile) error {
+    z.mu.Lock()
+    defer z.mu.Unlock()
+    w, err := z.writer.Create(batchFileName(name))
+    if err != nil {
+        return err
+    }
+    return file.Write(w)
+}
+
+// Close (ZipSink) - завершение архива
+func (z *ZipSink) Close() error {
+    z.mu.Lock()
+    defer z.mu.Unlock()
+    return z.writer.Close()
+}
+
+// BatchError - ошибка рендера одного документа пакета
+type BatchError struct {
+    Index int
+    Name  string
+    Err   error
+}
+
+func (e *BatchError) Error() string {
+    return fmt.Sprintf("%s: %s", e.Name, e.Err.Error())
+}
+
+// BatchErrors - ошибки документов пакета (остальные документы отрендерены)
+type BatchErrors []*BatchError
+
+func (e BatchErrors) Error() string {
+    messages := make([]string, len(e))
+    for i, err := range e {
+        messages[i] = err.Error()
+    }
+    return fmt.Sprintf("Render batch: %d failed: %s", len(e), strings.Join(messages, "; "))
+}
+
+// SetWorkers (XlsxTemplateFile) - количество потоков пакетного рендера (по умолчанию - по числу CPU)
+func (s *XlsxTemplateFile) SetWorkers(n int) {
+    s.workers = n
+}
+
+// RenderBatch - пакетный рендер шаблона в несколько потоков
+// Элементы iter - данные документов, ключи (Key) - имена документов (по умолчанию номер элемента).
+// Ошибка документа не прерывает пакет: ошибки всех документов возвращаются как BatchErrors.
+// Отмена ctx останавливает выдачу новых документов, возвращается ctx.Err().
+// opts - ограничения рендера каждого документа (как в RenderContext)
+func RenderBatch(ctx context.Context, template *XlsxTemplateFile, iter Iterator, sink BatchSink, opts RenderOptions) error {
+    if template == nil || template.template == nil {
+        return fmt.Errorf("Not load template xlsx file")
+    }
+    workers := template.workers
+    if workers < 1 {
+        workers = runtime.NumCPU()
+    }
+    type batchItem struct {
+        index int
+        name  string
+        data  interface{}
+    }
+    var (
+        wg     sync.WaitGroup
+        mu     sync.Mutex
+        errs   BatchErrors
+        items  = make(chan batchItem)
+    )
+    fail := func(item batchItem, err error) {
+        mu.Lock()
+        errs = append(errs, &BatchError{Index: item.index, Name: item.name, Err: err})
+        mu.Unlock()
+    }
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for item := range items {
+                // Шаблон общий, результат у каждого документа свой
+                file := &XlsxTemplateFile{
+                    template: template.template,
+                    fontDir:  template.fontDir,
+                    keyOrder: template.keyOrder,
+                    parts:    template.parts,
+                    autoFit:  template.autoFit,
+                    outline:  template.outline,
+                }
+                if err := file.RenderContext(ctx, item.data, opts); err != nil {
+                    fail(item, err)
+                    continue
+                }
+                if err := sink.Put(item.name, file); err != nil {
+                    fail(item, err)
+                }
+            }
+        }()
+    }
+    // Итератор читается в одном потоке
+    index := 0
+    for ctx.Err() == nil && iter.Next() {
+        item := batchItem{index: index, name: fmt.Sprint(index), data: iter.Value()}
+        if key := iter.Key(); key != nil {
+            item.name = fmt.Sprint(key)
+        }
+        select {
+        case items <- item:
+            index++
+        case <-ctx.Done():
+        }
+    }
+    close(items)
+    wg.Wait()
+    closeIterator(iter)
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if err := iteratorErr(iter); err != nil {
+        return err
+    }
+    if len(errs) > 0 {
+        sort.Slice(errs, func(i, j int) bool {
+            return errs[i].Index < errs[j].Index
+        })
+        return errs
+    }
+    return nil
+}
+
+// batchFileName - имя файла документа пакета
+func batchFileName(name string) string {
+    name = strings.Map(func(r rune) rune {
+        if r == os.PathSeparator || r == '/' || r == '\\' || r == ':' {
+            return '_'
+        }
+        return r
+    }, name)
+    if !strings.HasSuffix(strings.ToLower(name), ".xlsx") {
+        name += ".xlsx"
+    }
+    return name
+}
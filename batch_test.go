@@ -0,0 +1,127 @@
+package xlsxt
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "bytes"
+    "context"
+    "testing"
+    "archive/zip"
+    "path/filepath"
+    "github.com/tealeg/xlsx"
+)
+
+// panicSource - источник данных с паникой при чтении
+type panicSource struct{}
+
+// Get (panicSource)
+func (panicSource) Get(string) (interface{}, bool) { panic("boom") }
+
+// Iterate (panicSource)
+func (panicSource) Iterate(string) Iterator { return nil }
+
+var batchRows = [][]string{
+    {"{{Name}}", "{{sum Items.Amount}}"},
+    {"{{#each Items}}"},
+    {"{{Name}}", "{{Amount}}"},
+    {"{{/each}}"},
+}
+
+// batchCustomers - n документов с ключами cust/NN, документ bad - с ошибкой
+func batchCustomers(n, bad int) Iterator {
+    var items, keys []interface{}
+    for i := 0; i < n; i++ {
+        if i == bad {
+            items = append(items, panicSource{})
+        } else {
+            items = append(items, map[string]interface{}{
+                "Name":  fmt.Sprint("c", i),
+                "Items": []map[string]interface{}{{"Name": "x", "Amount": i}, {"Name": "y", "Amount": 1}},
+            })
+        }
+        keys = append(keys, fmt.Sprintf("cust/%02d", i))
+    }
+    return NewSliceIterator(items, keys)
+}
+
+func TestRenderBatchCallback(t *testing.T) {
+    tpl := newTestTemplate(batchRows)
+    tpl.SetWorkers(4)
+    var (
+        mu      sync.Mutex
+        results = make(map[string][][]string)
+    )
+    err := RenderBatch(context.Background(), tpl, batchCustomers(20, 7), SinkFunc(func(name string, file *XlsxTemplateFile) error {
+        mu.Lock()
+        defer mu.Unlock()
+        results[name] = resultValues(file.result.Sheets[0])
+        return nil
+    }), RenderOptions{})
+    // Ошибка документа не прерывает пакет
+    errs, ok := err.(BatchErrors)
+    if !ok || len(errs) != 1 || errs[0].Index != 7 || errs[0].Name != "cust/07" {
+        t.Fatalf("error: %v", err)
+    }
+    if len(results) != 19 {
+        t.Fatalf("results: %d", len(results))
+    }
+    checkValues(t, results["cust/03"], [][]string{{"c3", "4"}, {"x", "3"}, {"y", "1"}})
+    // Шаблон не меняется
+    if tpl.result != nil {
+        t.Error("template has result")
+    }
+}
+
+func TestRenderBatchZipSink(t *testing.T) {
+    var buf bytes.Buffer
+    sink := NewZipSink(&buf)
+    if err := RenderBatch(context.Background(), newTestTemplate(batchRows), batchCustomers(5, -1), sink, RenderOptions{}); err != nil {
+        t.Fatal(err)
+    }
+    if err := sink.Close(); err != nil {
+        t.Fatal(err)
+    }
+    reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    names := make(map[string]bool)
+    for _, f := range reader.File {
+        names[f.Name] = true
+    }
+    if len(names) != 5 || !names["cust_00.xlsx"] || !names["cust_04.xlsx"] {
+        t.Errorf("files: %v", names)
+    }
+}
+
+func TestRenderBatchDirSink(t *testing.T) {
+    dir := t.TempDir()
+    items := NewSliceIterator([]interface{}{map[string]interface{}{"Name": "a"}, map[string]interface{}{"Name": "b"}}, nil)
+    if err := RenderBatch(context.Background(), newTestTemplate(batchRows), items, DirSink(dir), RenderOptions{}); err != nil {
+        t.Fatal(err)
+    }
+    file, err := xlsx.OpenFile(filepath.Join(dir, "1.xlsx"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if value := file.Sheets[0].Rows[0].Cells[0].Value; value != "b" {
+        t.Errorf("1.xlsx: %q", value)
+    }
+    if _, err := os.Stat(filepath.Join(dir, "0.xlsx")); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestRenderBatchCancel(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    put := 0
+    err := RenderBatch(ctx, newTestTemplate(batchRows), batchCustomers(50, -1), SinkFunc(func(string, *XlsxTemplateFile) error {
+        put++
+        return nil
+    }), RenderOptions{})
+    if err != context.Canceled || put != 0 {
+        t.Errorf("error: %v, put %d", err, put)
+    }
+}
@@ -0,0 +1,891 @@
+package xlsxt
+
+import (
+    "fmt"
+    "errors"
+    "regexp"
+    "reflect"
+    "strings"
+    "strconv"
+    "sync/atomic"
+    "github.com/tealeg/xlsx"
+)
+
+var (
+    // {{#group Items by=Category}} ... {{/group}}
+    // {{#each Items sort="-Amount,Name" where="Amount > 0" limit=10}} ... {{/each}}
+    // {{#each Items zip=Payments}} ... {{/each}} - параллельный обход коллекций
+    // {{#each Items empty=hide}} ... {{else}} ... {{/each}} - строки для пустой коллекции
+    // {{#tree Nodes children=Children indent=A}} ... {{/tree}} - дерево произвольной глубины
+    // {{#define product}} ... {{/define}} - именованный шаблон строк, {{#each Items row=Kind}} - выбор
+    // шаблона для элемента по значению поля
+    rxBlockOpen    = regexp.MustCompile(`^\s*\{\{\s*#(\w+)\s+([\w\.]+)(.*?)\s*\}\}\s*$`)
+    rxBlockClose   = regexp.MustCompile(`^\s*\{\{\s*/(\w+)\s*\}\}\s*$`)
+    rxBlockElse    = regexp.MustCompile(`^\s*\{\{\s*else\s*\}\}\s*$`)
+    rxGroupHeader  = regexp.MustCompile(`\[\s?group-header\s?\]`)
+    rxGroupFooter  = regexp.MustCompile(`\[\s?group-footer\s?\]`)
+    rxBlockHeader  = regexp.MustCompile(`\[\s?header\s?\]`)
+    rxBlockFooter  = regexp.MustCompile(`\[\s?footer\s?\]`)
+    rxColumn       = regexp.MustCompile(`^[A-Za-z]{1,3}$`)
+)
+
+// block - элемент разобранного шаблона вкладки: строка или блок строк
+type block struct {
+    kind     string            // тип блока (each, group, tree, define), пустой для строки
+    path     []string          // путь к коллекции
+    args     map[string]string // аргументы директивы (by=Category)
+    where    *filter           // отбор элементов (where=)
+    sort     []sortKey         // сортировка элементов (sort=)
+    limit    int               // ограничение количества элементов (limit=)
+    zip      [][]string        // параллельные коллекции (zip=Payments,Notes)
+    nodes    []string          // путь к дочерним узлам дерева (children=Children)
+    indent   []int             // колонки с отступом по глубине узла дерева (indent=A,B)
+    row      *xlsx.Row         // строка шаблона (только для строки)
+    children []*block
+    empty    []*block          // строки после {{else}} - выводятся, если коллекция пуста
+    inElse   bool              // разбор строк после {{else}}
+}
+
+// add (block) - добавление строки или вложенного блока (после {{else}} - в empty)
+func (b *block) add(child *block) {
+    if b.inElse {
+        b.empty = append(b.empty, child)
+    } else {
+        b.children = append(b.children, child)
+    }
+}
+
+// parseBlocks - разбор строк шаблона на строки и блоки
+func parseBlocks(rows []*xlsx.Row) ([]*block, error) {
+    root := &block{}
+    stack := []*block{root}
+    for _, row := range rows {
+        current := stack[len(stack)-1]
+        if value, ok := directiveValue(row); ok {
+            if match := rxBlockOpen.FindStringSubmatch(value); match != nil {
+                b := &block{
+                    kind: match[1],
+                    path: strings.Split(match[2], "."),
+                    args: parseHashArgs(match[3]),
+                }
+                if err := b.parseArgs(); err != nil {
+                    return nil, fmt.Errorf("%s: %s", err.Error(), value)
+                }
+                current.add(b)
+                stack = append(stack, b)
+                continue
+            }
+            if rxBlockElse.MatchString(value) {
+                if len(stack) < 2 || current.inElse {
+                    return nil, fmt.Errorf("Unexpected else: %s", value)
+                }
+                current.inElse = true
+                continue
+            }
+            if match := rxBlockClose.FindStringSubmatch(value); match != nil {
+                if len(stack) < 2 || current.kind != match[1] {
+                    return nil, fmt.Errorf("Unexpected block close: %s", value)
+                }
+                stack = stack[:len(stack)-1]
+                continue
+            }
+        }
+        current.add(&block{row: row})
+    }
+    if len(stack) > 1 {
+        return nil, fmt.Errorf("Not closed block: %s %s", stack[len(stack)-1].kind, strings.Join(stack[len(stack)-1].path, "."))
+    }
+    return root.children, nil
+}
+
+// parseArgs (block) - проверка и разбор аргументов директивы
+func (b *block) parseArgs() error {
+    switch b.kind {
+    case "each":
+    case "group":
+        if len(b.args["by"]) < 1 {
+            return errors.New("Group block without key (by=)")
+        }
+    case "tree":
+        if len(b.args["children"]) < 1 {
+            return errors.New("Tree block without children (children=)")
+        }
+        b.nodes = strings.Split(b.args["children"], ".")
+        for _, col := range strings.Split(b.args["indent"], ",") {
+            if col = strings.TrimSpace(col); len(col) > 0 {
+                if !rxColumn.MatchString(col) {
+                    return errors.New("Invalid indent (column letters)")
+                }
+                b.indent = append(b.indent, xlsx.ColLettersToIndex(strings.ToUpper(col)))
+            }
+        }
+    case "define":
+        if len(b.args) > 0 {
+            return errors.New("Row template without arguments expected")
+        }
+    default:
+        return errors.New("Unknown block directive")
+    }
+    if _, ok := b.args["row"]; ok && b.kind != "each" && b.kind != "tree" {
+        return errors.New("row= is supported only by each and tree blocks")
+    }
+    var err error
+    if b.where, err = parseFilter(b.args["where"]); err != nil {
+        return err
+    }
+    b.sort = parseSort(b.args["sort"])
+    if zip, ok := b.args["zip"]; ok {
+        if b.kind != "each" {
+            return errors.New("zip= is supported only by each block")
+        }
+        for _, path := range strings.Split(zip, ",") {
+            if path = strings.TrimSpace(path); len(path) > 0 {
+                b.zip = append(b.zip, strings.Split(path, "."))
+            }
+        }
+    }
+    if limit, ok := b.args["limit"]; ok {
+        if b.limit, err = strconv.Atoi(limit); err != nil || b.limit < 0 {
+            return errors.New("Invalid limit")
+        }
+    }
+    if empty, ok := b.args["empty"]; ok && empty != "keep" && empty != "hide" {
+        return errors.New("Invalid empty= (keep or hide)")
+    }
+    return nil
+}
+
+// collection (block) - элементы коллекции блока с учетом where, sort и limit
+// Для карт возвращаются также ключи элементов
+func (b *block) collection(sc *scope) ([]interface{}, []interface{}) {
+    it := b.iterate(sc)
+    defer closeIterator(it)
+    return drainIterator(it)
+}
+
+// iterate (block) - обход коллекции блока с учетом where, sort и limit
+// Потоковые источники (итераторы, каналы) без sort= не собираются в память,
+// а читаются по одному элементу
+func (b *block) iterate(sc *scope) Iterator {
+    return b.refine(sc.iterate(b.path))
+}
+
+// refine (block) - отбор, сортировка и ограничение элементов обхода (where, sort, limit)
+func (b *block) refine(it Iterator) Iterator {
+    _, sized := it.(sizedIterator)
+    if b.where != nil {
+        it = &filterIterator{Iterator: it, where: b.where}
+    }
+    _, limit := b.args["limit"]
+    if !sized && len(b.sort) < 1 {
+        if limit {
+            it = &limitIterator{Iterator: it, limit: b.limit}
+        }
+        return it
+    }
+    // Коллекция в памяти - собираем отобранные элементы, чтобы знать их количество (@count)
+    items, keys := drainIterator(it)
+    closeIterator(it)
+    sortItems(items, keys, b.sort)
+    if limit && b.limit < len(items) {
+        items = items[:b.limit]
+        if keys != nil {
+            keys = keys[:b.limit]
+        }
+    }
+    return NewSliceIterator(items, keys)
+}
+
+// directiveValue - содержимое строки, если в ней только одна заполненная ячейка с директивой
+func directiveValue(row *xlsx.Row) (string, bool) {
+    value := ""
+    for _, cell := range row.Cells {
+        if cell != nil && len(strings.TrimSpace(cell.Value)) > 0 {
+            if len(value) > 0 {
+                return "", false
+            }
+            value = cell.Value
+        }
+    }
+    if rxBlockOpen.MatchString(value) || rxBlockClose.MatchString(value) || rxBlockElse.MatchString(value) {
+        return value, true
+    }
+    return "", false
+}
+
+// scope - область видимости при рендере блока
+type scope struct {
+    id     uint64        // номер области (растет при создании, не повторяется)
+    parent *scope
+    path   []string      // путь коллекции, к которой привязана область
+    value  reflect.Value // текущий элемент (для подстановки значений)
+    items  reflect.Value // элементы области (для агрегатов): группа или сам элемент
+    index  int           // номер элемента в коллекции (@index)
+    count  int           // количество элементов коллекции (-1 - неизвестно при потоковом обходе)
+    last   bool          // последний элемент коллекции (@last)
+    key    interface{}   // ключ группы (@key)
+    zip    []*scope      // элементы параллельных коллекций с тем же индексом
+    less   func(a, b interface{}) bool // порядок ключей карт (только в корневой области)
+    stream *rowStream    // потоковая запись строк (только в корневой области)
+    guard  *renderGuard  // отмена и ограничения рендера (только в корневой области)
+    level  int           // глубина узла дерева (@depth)
+    numbering string     // иерархический номер узла дерева (@numbering), пустой вне дерева
+    indent []int         // колонки с отступом по глубине узла дерева
+    rows   *rowMap       // строки результата по строкам шаблона (только в корневой области)
+    defines map[string]*block // именованные шаблоны строк (только в корневой области)
+    outline bool         // уровни структуры строк по вложенности (только в корневой области)
+    absolute bool        // элемент строки вне блоков: пути считаются от корня ({{Name}} - поле корня)
+}
+
+// newScope - корневая область видимости
+func newScope(v interface{}) *scope {
+    val := reflect.ValueOf(v)
+    return &scope{id: nextScopeID(), value: val, items: val}
+}
+
+// lastScopeID - номер последней созданной области видимости
+var lastScopeID uint64
+
+// nextScopeID - номер новой области видимости
+func nextScopeID() uint64 {
+    return atomic.AddUint64(&lastScopeID, 1)
+}
+
+// bind (scope) - ближайшая область, к которой относится путь, и остаток пути
+func (s *scope) bind(path []string) (*scope, []string) {
+    for sc := s; sc != nil; sc = sc.parent {
+        for _, z := range sc.zip {
+            if hasPrefix(path, z.path) {
+                return z, path[len(z.path):]
+            }
+        }
+        if hasPrefix(path, sc.path) {
+            return sc, path[len(sc.path):]
+        }
+    }
+    return nil, path
+}
+
+// lookup (scope) - как bind, но путь, не привязанный к коллекциям, сначала ищется
+// относительно текущих элементов блоков (от ближайшего к корню)
+func (s *scope) lookup(path []string) (*scope, []string) {
+    sc, rest := s.bind(path)
+    if sc != nil && sc.parent == nil && len(path) > 0 {
+        for cur := s; cur != nil && cur.parent != nil && !cur.absolute; cur = cur.parent {
+            if _, ok := findValue(cur.value, path[0]); ok {
+                return cur, path
+            }
+        }
+    }
+    return sc, rest
+}
+
+// depth (scope) - глубина вложенности области в коллекции (0 - корневая область)
+func (s *scope) depth() int {
+    depth := 0
+    for ; s.parent != nil; s = s.parent {
+        depth++
+    }
+    return depth
+}
+
+// up (scope) - область на n уровней выше (../)
+func (s *scope) up(n int) *scope {
+    for ; n > 0 && s.parent != nil; n-- {
+        s = s.parent
+    }
+    return s
+}
+
+// meta (scope) - метаданные цикла: @index, @number, @first, @last, @count, @key,
+// в дереве - @depth, @numbering
+func (s *scope) meta(name string) (interface{}, bool) {
+    if s.parent == nil {
+        return nil, false
+    }
+    switch name {
+    case "index":
+        return s.index, true
+    case "number":
+        return s.index+1, true
+    case "first":
+        return s.index == 0, true
+    case "last":
+        return s.last, true
+    case "count":
+        return s.count, s.count >= 0
+    case "key":
+        return s.key, s.key != nil
+    case "depth":
+        return s.level, len(s.numbering) > 0
+    case "numbering":
+        return s.numbering, len(s.numbering) > 0
+    }
+    return nil, false
+}
+
+// collection (scope) - элементы коллекции по пути
+// once - единственное чтение однократных источников (каналов, курсоров), иначе они - ошибка
+func (s *scope) collection(path []string, once bool) ([]interface{}, error) {
+    var values []interface{}
+    if sc, rest := s.lookup(path); sc != nil {
+        if err := collectValues(sc.items, reflect.Value{}, rest, nil, once, &values); err != nil {
+            return nil, err
+        }
+    }
+    return values, nil
+}
+
+// entries (scope) - элементы коллекции по пути через DataSource; карта обходится как
+// коллекция значений в порядке ключей, ключи возвращаются вторым значением
+func (s *scope) entries(path []string) ([]interface{}, []interface{}) {
+    return drainIterator(s.iterate(path))
+}
+
+// root (scope) - корневая область видимости
+func (s *scope) root() *scope {
+    for s.parent != nil {
+        s = s.parent
+    }
+    return s
+}
+
+// keyOrder (scope) - порядок ключей карт из корневой области
+func (s *scope) keyOrder() func(a, b interface{}) bool {
+    return s.root().less
+}
+
+// iterate (scope) - обход коллекции по пути без сбора элементов (через DataSource)
+func (s *scope) iterate(path []string) Iterator {
+    if sc, rest := s.lookup(path); sc != nil && len(rest) > 0 {
+        if it := sourceOf(sc.items, s.keyOrder()).Iterate(strings.Join(rest, ".")); it != nil {
+            return it
+        }
+    }
+    // Путь через вложенные коллекции (Items.SubItems) - элементы всех коллекций подряд
+    items, err := s.collection(path, true)
+    return &sliceIterator{items: items, index: -1, err: err}
+}
+
+// context (scope) - значения для подстановки в строку ({{Items.Name}} -> Items_Name)
+// {{../Name}} - значение родительской области, {{@row}} - номер строки результата,
+// {{Items:length}} по однократному источнику (каналу, курсору) - ошибка
+func (s *scope) context(row *xlsx.Row) (map[string]interface{}, error) {
+    ctx := make(map[string]interface{})
+    for _, cell := range row.Cells {
+        if cell == nil {
+            continue
+        }
+        for _, expr := range templatePaths(cell.Value) {
+            length := strings.HasSuffix(expr, ":length")
+            expr = strings.TrimSuffix(expr, ":length")
+            key := contextKey(expr)
+            sc, up := s, false
+            for strings.HasPrefix(expr, "../") {
+                expr = expr[3:]
+                sc, up = sc.up(1), true
+            }
+            if strings.HasPrefix(expr, "@") {
+                if expr == "@row" && row.Sheet != nil {
+                    ctx[key] = len(row.Sheet.Rows) + s.root().stream.written()
+                } else if v, ok := sc.meta(expr[1:]); ok {
+                    ctx[key] = v
+                }
+                continue
+            }
+            if expr == "this" {
+                ctx[key] = displayValue(sc.value)
+                continue
+            }
+            path := strings.Split(strings.TrimPrefix(expr, "this."), ".")
+            if length {
+                items, err := sc.collection(path, false)
+                if err != nil {
+                    return nil, fmt.Errorf("%s: %s:length", err.Error(), expr)
+                }
+                ctx[key+"_length"] = len(items)
+                continue
+            }
+            target, rest := sc.lookup(path)
+            // {{../Field}} - поле самого родительского элемента
+            if up && sc.parent != nil {
+                if _, ok := findValue(sc.value, path[0]); ok {
+                    target, rest = sc, path
+                }
+            }
+            if sc := target; sc != nil {
+                if len(path) > 1 {
+                    ctx["@"+strings.Join(path[:len(path)-1], "_")] = sc
+                }
+                if v, ok := findPath(sc.value, rest); ok {
+                    ctx[key] = displayValue(v)
+                    if len(rest) == 1 && isSQLRow(sc.value) {
+                        typedKeys(ctx)[key] = true
+                    }
+                }
+            }
+        }
+    }
+    return ctx, nil
+}
+
+// hasPrefix - начинается ли путь с префикса
+func hasPrefix(path, prefix []string) bool {
+    if len(prefix) > len(path) {
+        return false
+    }
+    for i := range prefix {
+        if path[i] != prefix[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// renderBlocks - рендер списка строк и блоков в области видимости
+func renderBlocks(blocks []*block, sc *scope, sheet *xlsx.Sheet) error {
+    for _, b := range blocks {
+        if b.row != nil {
+            if err := renderScopeRow(b.row, sc, sheet); err != nil {
+                return err
+            }
+            continue
+        }
+        if err := renderBlock(b, sc, sheet); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// renderBlock - рендер блока
+func renderBlock(b *block, sc *scope, sheet *xlsx.Sheet) error {
+    switch b.kind {
+    case "each":
+        return renderEach(b, sc, sheet)
+    case "group":
+        return renderGroup(b, sc, sheet)
+    case "tree":
+        return renderTree(b, sc, sheet)
+    case "define":
+        // Шаблон строк выводится только циклами с row=
+        return nil
+    }
+    return fmt.Errorf("Unknown block directive: %s", b.kind)
+}
+
+// renderEach - рендер блока повторения: строки и вложенные блоки выводятся для каждого элемента
+// С zip= коллекции обходятся параллельно по индексу, до конца самой длинной
+// Строки [header]/[footer] выводятся один раз до и после элементов (для пустой коллекции
+// при empty=hide не выводятся), строки после {{else}} - только для пустой коллекции
+func renderEach(b *block, sc *scope, sheet *xlsx.Sheet) (err error) {
+    it := b.iterate(sc)
+    defer closeIterator(it)
+    zipped := make([][]interface{}, len(b.zip))
+    zipCount := 0
+    for i, path := range b.zip {
+        if zipped[i], err = sc.collection(path, true); err != nil {
+            return err
+        }
+        if len(zipped[i]) > zipCount {
+            zipCount = len(zipped[i])
+        }
+    }
+    // Количество элементов известно только для коллекций в памяти
+    count := -1
+    if sized, ok := it.(sizedIterator); ok {
+        if count = sized.Len(); zipCount > count {
+            count = zipCount
+        }
+    }
+    // Элемент читается на шаг вперед, чтобы знать @last
+    next := it.Next()
+    empty := !next && zipCount < 1
+    var header, body, footer []*block
+    for _, child := range b.children {
+        if child.row != nil && rowHasMarker(child.row, rxBlockHeader) {
+            header = append(header, child)
+        } else if child.row != nil && rowHasMarker(child.row, rxBlockFooter) {
+            footer = append(footer, child)
+        } else {
+            body = append(body, child)
+        }
+    }
+    showHeader := !empty || b.args["empty"] != "hide"
+    if showHeader {
+        if err := renderBlocks(header, sc, sheet); err != nil {
+            return err
+        }
+    }
+    if empty {
+        if err := renderBlocks(b.empty, sc, sheet); err != nil {
+            return err
+        }
+    }
+    guard := sc.root().guard
+    for i := 0; next || i < zipCount; i++ {
+        if err := guard.check(); err != nil {
+            return err
+        }
+        itemScope := &scope{
+            id:     nextScopeID(),
+            parent: sc,
+            path:   b.path,
+            index:  i,
+            count:  count,
+        }
+        if next {
+            itemScope.value = reflect.ValueOf(it.Value())
+            itemScope.items = itemScope.value
+            itemScope.key = it.Key()
+            next = it.Next()
+        }
+        itemScope.last = !next && i+1 >= zipCount
+        for z, path := range b.zip {
+            zipScope := &scope{id: nextScopeID(), parent: sc, path: path, index: i, count: count, last: itemScope.last}
+            if i < len(zipped[z]) {
+                zipScope.value = reflect.ValueOf(zipped[z][i])
+                zipScope.items = zipScope.value
+            }
+            itemScope.zip = append(itemScope.zip, zipScope)
+        }
+        if err := renderBlocks(b.itemBlocks(itemScope, body), itemScope, sheet); err != nil {
+            return err
+        }
+    }
+    if err := iteratorErr(it); err != nil {
+        return err
+    }
+    if showHeader {
+        return renderBlocks(footer, sc, sheet)
+    }
+    return nil
+}
+
+// renderGroup - рендер блока группировки
+// Строки с [group-header]/[group-footer] и вложенные блоки выводятся один раз на группу,
+// остальные строки повторяются для каждого элемента группы
+func renderGroup(b *block, sc *scope, sheet *xlsx.Sheet) error {
+    by := strings.Split(b.args["by"], ".")
+    var (
+        keys   []string
+        values = make(map[string]interface{})
+        groups = make(map[string][]interface{})
+    )
+    items, _ := b.collection(sc)
+    if len(items) < 1 {
+        return renderBlocks(b.empty, sc, sheet)
+    }
+    for _, item := range items {
+        key, value := "", interface{}("")
+        if v, ok := findPath(reflect.ValueOf(item), by); ok {
+            if v = indirect(v); v.IsValid() {
+                value = v.Interface()
+                key = fmt.Sprint(value)
+            }
+        }
+        if _, ok := groups[key]; !ok {
+            keys = append(keys, key)
+            values[key] = value
+        }
+        groups[key] = append(groups[key], item)
+    }
+    for index, key := range keys {
+        items := groups[key]
+        groupScope := &scope{
+            id:     nextScopeID(),
+            parent: sc,
+            path:   b.path,
+            value:  reflect.ValueOf(items[0]),
+            items:  reflect.ValueOf(items),
+            index:  index,
+            count:  len(keys),
+            last:   index == len(keys)-1,
+            key:    values[key],
+        }
+        for i := 0; i < len(b.children); i++ {
+            child := b.children[i]
+            if child.row == nil {
+                if err := renderBlock(child, groupScope, sheet); err != nil {
+                    return err
+                }
+                continue
+            }
+            if isGroupRow(child.row) {
+                if err := renderScopeRow(child.row, groupScope, sheet); err != nil {
+                    return err
+                }
+                continue
+            }
+            // Собираем подряд идущие строки элемента
+            j := i
+            for j < len(b.children) && b.children[j].row != nil && !isGroupRow(b.children[j].row) {
+                j++
+            }
+            for itemIndex, item := range items {
+                itemScope := &scope{
+                    id:     nextScopeID(),
+                    parent: groupScope,
+                    path:   b.path,
+                    value:  reflect.ValueOf(item),
+                    items:  reflect.ValueOf(item),
+                    index:  itemIndex,
+                    count:  len(items),
+                    last:   itemIndex == len(items)-1,
+                }
+                if err := renderBlocks(b.children[i:j], itemScope, sheet); err != nil {
+                    return err
+                }
+            }
+            i = j - 1
+        }
+    }
+    return nil
+}
+
+// itemBlocks (block) - строки элемента цикла: шаблон {{#define}} с именем из поля row= элемента
+// (row=Kind: Kind == "product" -> {{#define product}}), без шаблона - строки самого цикла
+func (b *block) itemBlocks(sc *scope, body []*block) []*block {
+    field, ok := b.args["row"]
+    if !ok {
+        return body
+    }
+    v, ok := findPath(sc.value, strings.Split(field, "."))
+    if v = indirect(v); !ok || !v.IsValid() || !v.CanInterface() {
+        return body
+    }
+    if define, ok := sc.root().defines[fmt.Sprint(v.Interface())]; ok {
+        return define.children
+    }
+    return body
+}
+
+// parseDefines - именованные шаблоны строк ({{#define}}) всех вкладок шаблона
+func parseDefines(file *xlsx.File) (map[string]*block, error) {
+    defines := make(map[string]*block)
+    for _, sheet := range file.Sheets {
+        blocks, err := parseBlocks(sheet.Rows)
+        if err != nil {
+            return nil, err
+        }
+        for _, b := range blocks {
+            if b.kind != "define" {
+                continue
+            }
+            name := strings.Join(b.path, ".")
+            if _, ok := defines[name]; ok {
+                return nil, fmt.Errorf("Duplicate row template: %s", name)
+            }
+            defines[name] = b
+        }
+    }
+    return defines, nil
+}
+
+// isDefinesSheet - вкладка шаблона содержит только шаблоны строк ({{#define}}) и в результат не выводится
+func isDefinesSheet(sheet *xlsx.Sheet) bool {
+    blocks, err := parseBlocks(sheet.Rows)
+    if err != nil {
+        return false
+    }
+    defines := 0
+    for _, b := range blocks {
+        switch {
+        case b.kind == "define":
+            defines++
+        case b.row != nil && isEmptyRow(b.row):
+        default:
+            return false
+        }
+    }
+    return defines > 0
+}
+
+// outputSheets - количество вкладок результата (без вкладок только с {{#define}})
+func outputSheets(file *xlsx.File) int {
+    n := 0
+    for _, sheet := range file.Sheets {
+        if !isDefinesSheet(sheet) {
+            n++
+        }
+    }
+    return n
+}
+
+// isEmptyRow - нет заполненных ячеек
+func isEmptyRow(row *xlsx.Row) bool {
+    for _, cell := range row.Cells {
+        if cell != nil && len(strings.TrimSpace(cell.Value)) > 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// renderTree - рендер дерева: строки блока выводятся для каждого узла в глубину (узел, затем его
+// дочерние узлы из коллекции children=), where/sort/limit применяются на каждом уровне.
+// @depth - глубина узла (с нуля), @numbering - иерархический номер (1.2.3), indent= - отступ ячеек
+// колонок по глубине узла; уровень структуры строк (SetOutline) растет с глубиной узла.
+// Глубина не ограничена, узел, вложенный в самого себя (цикл ссылок), - ошибка
+func renderTree(b *block, sc *scope, sheet *xlsx.Sheet) error {
+    it := b.iterate(sc)
+    items, keys := drainIterator(it)
+    closeIterator(it)
+    if err := iteratorErr(it); err != nil {
+        return err
+    }
+    if len(items) < 1 {
+        return renderBlocks(b.empty, sc, sheet)
+    }
+    return renderTreeNodes(b, sc, sheet, items, keys, "", 0, make(map[treeNodeKey]bool))
+}
+
+// treeNodeKey - адрес узла дерева (ссылка или карта) для поиска циклов
+type treeNodeKey struct {
+    t reflect.Type
+    p uintptr
+}
+
+// nodeKey - адрес узла дерева, false - узел-значение (не может образовать цикл)
+func nodeKey(v reflect.Value) (treeNodeKey, bool) {
+    for v.IsValid() && v.Kind() == reflect.Interface {
+        v = v.Elem()
+    }
+    if !v.IsValid() || (v.Kind() != reflect.Ptr && v.Kind() != reflect.Map) || v.IsNil() {
+        return treeNodeKey{}, false
+    }
+    return treeNodeKey{t: v.Type(), p: v.Pointer()}, true
+}
+
+// renderTreeNodes - рендер узлов одного уровня дерева и их дочерних узлов
+// ancestors - узлы пути от корня дерева: узел, ссылающийся на своего предка, - ошибка (цикл)
+func renderTreeNodes(b *block, sc *scope, sheet *xlsx.Sheet, items, keys []interface{}, prefix string, level int, ancestors map[treeNodeKey]bool) error {
+    guard := sc.root().guard
+    for i, item := range items {
+        if err := guard.check(); err != nil {
+            return err
+        }
+        node := &scope{
+            id:        nextScopeID(),
+            parent:    sc,
+            path:      b.path,
+            value:     reflect.ValueOf(item),
+            items:     reflect.ValueOf(item),
+            index:     i,
+            count:     len(items),
+            last:      i == len(items)-1,
+            level:     level,
+            numbering: prefix + strconv.Itoa(i+1),
+            indent:    b.indent,
+        }
+        if keys != nil {
+            node.key = keys[i]
+        }
+        key, ref := nodeKey(node.value)
+        if ref && ancestors[key] {
+            return fmt.Errorf("Tree has a cycle: %s (%s)", strings.Join(b.path, "."), node.numbering)
+        }
+        if err := renderBlocks(b.itemBlocks(node, b.children), node, sheet); err != nil {
+            return err
+        }
+        it := sourceOf(node.value, sc.keyOrder()).Iterate(strings.Join(b.nodes, "."))
+        if it == nil {
+            continue
+        }
+        it = b.refine(it)
+        children, childKeys := drainIterator(it)
+        closeIterator(it)
+        if err := iteratorErr(it); err != nil {
+            return err
+        }
+        if ref {
+            ancestors[key] = true
+        }
+        if err := renderTreeNodes(b, node, sheet, children, childKeys, node.numbering+".", level+1, ancestors); err != nil {
+            return err
+        }
+        if ref {
+            delete(ancestors, key)
+        }
+    }
+    return nil
+}
+
+// indentCells - отступ ячеек колонок columns строки на level уровней
+func indentCells(row *xlsx.Row, columns []int, level int) {
+    for _, col := range columns {
+        if col >= len(row.Cells) || row.Cells[col] == nil || level < 1 {
+            continue
+        }
+        cell := row.Cells[col]
+        style := xlsx.NewStyle()
+        if cs := cell.GetStyle(); cs != nil {
+            *style = *cs
+        }
+        // Отступ в Excel работает только при выравнивании по левому или правому краю
+        if len(style.Alignment.Horizontal) < 1 || style.Alignment.Horizontal == "general" {
+            style.Alignment.Horizontal = "left"
+        }
+        style.Alignment.Indent += level
+        style.ApplyAlignment = true
+        cell.SetStyle(style)
+    }
+}
+
+// isGroupRow - строка выводится один раз на группу
+func isGroupRow(row *xlsx.Row) bool {
+    return rowHasMarker(row, rxGroupHeader) || rowHasMarker(row, rxGroupFooter)
+}
+
+// rowHasMarker - есть ли в ячейках строки метка
+func rowHasMarker(row *xlsx.Row, rx *regexp.Regexp) bool {
+    for _, cell := range row.Cells {
+        if cell != nil && rx.MatchString(cell.Value) {
+            return true
+        }
+    }
+    return false
+}
+
+// renderScopeRow - рендер строки шаблона в области видимости
+func renderScopeRow(row *xlsx.Row, sc *scope, sheet *xlsx.Sheet) error {
+    newRow := sheet.AddRow()
+    cloneRow(row, newRow)
+    for _, cell := range newRow.Cells {
+        for _, rx := range []*regexp.Regexp{rxGroupHeader, rxGroupFooter, rxBlockHeader, rxBlockFooter} {
+            cell.Value = rx.ReplaceAllString(cell.Value, "")
+        }
+    }
+    // Агрегаты строки вне блоков считаются от корня, как и ее пути
+    aggregates := sc
+    if sc.absolute {
+        aggregates = sc.root()
+    }
+    if err := renderAggregates(newRow, aggregates); err != nil {
+        return err
+    }
+    ctx, err := sc.context(newRow)
+    if err != nil {
+        return err
+    }
+    if err := renderRow(newRow, ctx); err != nil {
+        return err
+    }
+    if len(sc.indent) > 0 {
+        indentCells(newRow, sc.indent, sc.level)
+    }
+    root := sc.root()
+    if root.outline {
+        depth := sc.depth()
+        if sc.absolute && sc.count == 0 {
+            // Строка пустой вложенной коллекции - на уровне родителя
+            depth--
+        }
+        newRow.OutlineLevel = outlineLevel(depth)
+    }
+    root.rows.add(row, len(sheet.Rows)-1)
+    if err := root.guard.row(newRow); err != nil {
+        return err
+    }
+    return root.stream.flush(sheet)
+}
@@ -0,0 +1,391 @@
+package xlsxt
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+)
+
+type groupItem struct {
+    Name, Category, Region string
+    Amount                 float64
+}
+
+var groupData = struct {
+    Title string
+    Items []groupItem
+}{"T", []groupItem{{"a", "x", "N", 1}, {"b", "y", "S", 2}, {"c", "x", "S", 3}, {"d", "y", "N", 4.5}}}
+
+func TestGroupHeadersAndSubtotals(t *testing.T) {
+    values := renderTestValues(t, [][]string{
+        {"{{#group Items by=Category}}"},
+        {"[group-header]{{Items.Category}}", "{{count Items}} pcs"},
+        {"{{Items.Name}}", "{{Items.Amount}}", "{{Title}}"},
+        {"Total {{Items.Category}}[group-footer]", "{{sum Items.Amount}}"},
+        {"{{/group}}"},
+        {"All", "{{sum Items.Amount}}"},
+    }, groupData)
+    // Группы - в порядке первого появления ключа, итоги группы - по ее элементам
+    checkValues(t, values, [][]string{
+        {"x", "2 pcs"},
+        {"a", "1", "T"},
+        {"c", "3", "T"},
+        {"Total x", "4"},
+        {"y", "2 pcs"},
+        {"b", "2", "T"},
+        {"d", "4.5", "T"},
+        {"Total y", "6.5"},
+        {"All", "10.5"},
+    })
+}
+
+func TestNestedGroups(t *testing.T) {
+    values := renderTestValues(t, [][]string{
+        {"{{#group Items by=Region}}"},
+        {"[group-header]{{Items.Region}}", "{{sum Items.Amount}}"},
+        {"{{#group Items by=Category}}"},
+        {"[group-header] - {{Items.Category}}", "{{sum Items.Amount}}"},
+        {"{{/group}}"},
+        {"{{/group}}"},
+    }, groupData)
+    checkValues(t, values, [][]string{
+        {"N", "5.5"},
+        {" - x", "1"},
+        {" - y", "4.5"},
+        {"S", "5"},
+        {" - y", "2"},
+        {" - x", "3"},
+    })
+}
+
+func TestGroupOfEmptyCollection(t *testing.T) {
+    values := renderTestValues(t, [][]string{
+        {"{{#group Items by=Category}}"},
+        {"[group-header]{{Items.Category}}"},
+        {"{{/group}}"},
+        {"end"},
+    }, struct{ Items []groupItem }{})
+    checkValues(t, values, [][]string{{"end"}})
+}
+
+func TestBlockErrors(t *testing.T) {
+    for _, rows := range [][][]string{
+        {{"{{#group Items by=Category}}"}, {"{{Items.Name}}"}},
+        {{"{{#group Items}}"}, {"{{/group}}"}},
+        {{"{{/group}}"}},
+    } {
+        tpl := newTestTemplate(rows)
+        if err := tpl.RenderTemplate(groupData); err == nil {
+            t.Errorf("%q: no error", rows)
+        }
+    }
+}
+
+func TestEachSortWhereLimit(t *testing.T) {
+    values := renderTestValues(t, [][]string{
+        {`{{#each Items sort="-Amount,Name" where="Amount > 1" limit=2}}`},
+        {"{{Items.Name}}", "{{Items.Amount}}"},
+        {"{{/each}}"},
+        {"{{#each Items sort=Category,-Name}}"},
+        {"{{Items.Category}}", "{{Items.Name}}"},
+        {"{{/each}}"},
+    }, groupData)
+    // Фильтр и сортировка - до ограничения, исходная коллекция не меняется
+    checkValues(t, values, [][]string{
+        {"d", "4.5"},
+        {"c", "3"},
+        {"x", "c"},
+        {"x", "a"},
+        {"y", "d"},
+        {"y", "b"},
+    })
+}
+
+func TestEachErrors(t *testing.T) {
+    for _, rows := range [][][]string{
+        {{"{{#each Items limit=x}}"}, {"{{/each}}"}},
+        {{`{{#each Items where="Amount >"}}`}, {"{{/each}}"}},
+        {{"{{#each Items}}"}},
+    } {
+        tpl := newTestTemplate(rows)
+        if err := tpl.RenderTemplate(groupData); err == nil {
+            t.Errorf("%q: no error", rows)
+        }
+    }
+}
+
+type loopLine struct {
+    Name string
+    Qty  int
+}
+
+type loopOrder struct {
+    Number string
+    Lines  []loopLine
+}
+
+var loopData = struct {
+    Title  string
+    Orders []loopOrder
+}{"T", []loopOrder{{"A-1", []loopLine{{"x", 1}, {"y", 2}}}, {"B-2", []loopLine{{"z", 5}}}}}
+
+func TestLoopVariables(t *testing.T) {
+    values := renderTestValues(t, [][]string{
+        {"{{#each Orders}}"},
+        {"{{@number}}", "{{Number}} of {{@count}}", "{{Lines:length}} lines", "{{sum Lines.Qty}}"},
+        {"{{#each Lines}}"},
+        {"{{../@number}}.{{@number}}", "{{Name}} / {{../Number}} / {{Orders.Number}}", "{{@first}}-{{@last}}", "row {{@row}} {{Title}}"},
+        {"{{/each}}"},
+        {"{{/each}}"},
+        {"{{Orders.Lines.Name}}", "{{@number}}/{{@count}} r{{@row}}"},
+    }, loopData)
+    // В строке без блока переменные относятся к самой вложенной коллекции
+    checkValues(t, values, [][]string{
+        {"1", "A-1 of 2", "2 lines", "3"},
+        {"1.1", "x / A-1 / A-1", "true-false", "row 2 T"},
+        {"1.2", "y / A-1 / A-1", "false-true", "row 3 T"},
+        {"2", "B-2 of 2", "1 lines", "5"},
+        {"2.1", "z / B-2 / B-2", "true-true", "row 5 T"},
+        {"x", "1/2 r6"},
+        {"y", "2/2 r7"},
+        {"z", "1/1 r8"},
+    })
+}
+
+type zipItem struct {
+    Name string
+    Subs []loopLine
+}
+
+type zipPayment struct{ Sum int }
+
+var zipData = struct {
+    Items    []zipItem
+    Payments []zipPayment
+}{[]zipItem{{"a", []loopLine{{"s1", 1}, {"s2", 2}}}, {"b", nil}}, []zipPayment{{1}, {2}, {3}}}
+
+func TestEachZip(t *testing.T) {
+    values := renderTestValues(t, [][]string{
+        {"{{Items.Name}}", "{{Items.Subs.Name}}"},
+        {"{{#each Items zip=Payments}}"},
+        {"{{@number}}", "{{Items.Name}}", "{{Payments.Sum}}"},
+        {"{{/each}}"},
+    }, zipData)
+    // Вложенная коллекция без элементов - одна строка; zip - по самой длинной коллекции
+    checkValues(t, values, [][]string{
+        {"a", "s1"},
+        {"a", "s2"},
+        {"b", ""},
+        {"1", "a", "1"},
+        {"2", "b", "2"},
+        {"3", "", "3"},
+    })
+}
+
+func TestRowOfSeveralCollections(t *testing.T) {
+    tpl := newTestTemplate([][]string{{"{{Items.Name}}", "{{Payments.Sum}}"}})
+    err := tpl.RenderTemplate(zipData)
+    if err == nil || !strings.Contains(err.Error(), "zip=Payments") {
+        t.Errorf("error: %v", err)
+    }
+}
+
+var elseRows = [][]string{
+    {"{{#each Items}}"},
+    {"[header]Name", "Amount"},
+    {"{{Name}}", "{{Amount}}"},
+    {"[footer]Total", "{{sum Items.Amount}}"},
+    {"{{else}}"},
+    {"Нет данных"},
+    {"{{/each}}"},
+    {`{{#each Items where="Amount > 100" empty=hide}}`},
+    {"[header]H2"},
+    {"{{Name}}"},
+    {"{{else}}"},
+    {"Пусто {{Title}}"},
+    {"{{/each}}"},
+    {"{{#group Items by=Name}}"},
+    {"{{Name}}"},
+    {"{{else}}"},
+    {"no groups"},
+    {"{{/group}}"},
+}
+
+func TestEachElse(t *testing.T) {
+    // Пустая коллекция: заголовок и итог остаются (empty=hide - скрываются), вместо строк - else
+    values := renderTestValues(t, elseRows, struct {
+        Title string
+        Items []groupItem
+    }{Title: "T"})
+    checkValues(t, values, [][]string{
+        {"Name", "Amount"},
+        {"Нет данных"},
+        {"Total", "0"},
+        {"Пусто T"},
+        {"no groups"},
+    })
+    values = renderTestValues(t, elseRows, struct {
+        Title string
+        Items []groupItem
+    }{"U", []groupItem{{Name: "a", Amount: 1}}})
+    checkValues(t, values, [][]string{
+        {"Name", "Amount"},
+        {"a", "1"},
+        {"Total", "1"},
+        {"Пусто U"},
+        {"a"},
+    })
+}
+
+type treeNode struct {
+    Name     string
+    Children []*treeNode
+}
+
+var treeRows = [][]string{
+    {"Head"},
+    {"{{#tree Accounts children=Children indent=B sort=Name}}"},
+    {"{{@numbering}}", "{{Name}}", "{{@depth}}", "{{../Name}}"},
+    {"{{else}}"},
+    {"none"},
+    {"{{/tree}}"},
+    {"end"},
+}
+
+func TestTree(t *testing.T) {
+    tpl := newTestTemplate(treeRows)
+    tpl.SetOutline(OutlineSummaryAbove)
+    data := struct{ Accounts []*treeNode }{[]*treeNode{
+        {Name: "B", Children: []*treeNode{{Name: "B2"}, {Name: "B1", Children: []*treeNode{{Name: "B1a"}}}}},
+        {Name: "A"},
+    }}
+    if err := tpl.RenderTemplate(data); err != nil {
+        t.Fatal(err)
+    }
+    // Узел, затем его потомки (сортировка на каждом уровне), ../ - родительский узел
+    checkValues(t, resultValues(tpl.result.Sheets[0]), [][]string{
+        {"Head"},
+        {"1", "A", "0", ""},
+        {"2", "B", "0", ""},
+        {"2.1", "B1", "1", "B"},
+        {"2.1.1", "B1a", "2", "B1"},
+        {"2.2", "B2", "1", "B"},
+        {"end"},
+    })
+    // Отступ колонки indent и уровень структуры - по глубине узла
+    for i, want := range []int{0, 0, 0, 1, 2, 1, 0} {
+        row := tpl.result.Sheets[0].Rows[i]
+        if int(row.OutlineLevel) != want {
+            t.Errorf("row %d: level %d", i, row.OutlineLevel)
+        }
+        if len(row.Cells) > 1 && row.Cells[1].GetStyle().Alignment.Indent != want {
+            t.Errorf("row %d: indent %d", i, row.Cells[1].GetStyle().Alignment.Indent)
+        }
+    }
+    checkValues(t, renderTestValues(t, treeRows, struct{ Accounts []*treeNode }{}), [][]string{{"Head"}, {"none"}, {"end"}})
+}
+
+// treeChannel - узлы дерева в канале (однократный источник)
+func treeChannel(nodes ...*treeNode) interface{} {
+    ch := make(chan *treeNode, len(nodes))
+    for _, node := range nodes {
+        ch <- node
+    }
+    close(ch)
+    return struct{ Nodes chan *treeNode }{ch}
+}
+
+func TestTreeDepthAndCycles(t *testing.T) {
+    rows := [][]string{{"{{#tree Nodes children=Children}}"}, {"{{@numbering}}", "{{Name}}"}, {"{{/tree}}"}}
+    // Глубокая цепочка
+    root := &treeNode{Name: "0"}
+    for node, i := root, 1; i < 150; i++ {
+        node.Children = []*treeNode{{Name: "x"}}
+        node = node.Children[0]
+    }
+    if values := renderTestValues(t, rows, treeChannel(root)); len(values) != 150 {
+        t.Errorf("rows: %d", len(values))
+    }
+    // Общий потомок двух узлов - не цикл
+    shared := &treeNode{Name: "shared"}
+    values := renderTestValues(t, rows, treeChannel(&treeNode{"a", []*treeNode{shared}}, &treeNode{"b", []*treeNode{shared}}))
+    checkValues(t, values, [][]string{{"1", "a"}, {"1.1", "shared"}, {"2", "b"}, {"2.1", "shared"}})
+    // Цикл - ошибка
+    cycle := &treeNode{Name: "c"}
+    cycle.Children = []*treeNode{{Name: "d", Children: []*treeNode{cycle}}}
+    err := newTestTemplate(rows).RenderTemplate(treeChannel(cycle))
+    if err == nil || !strings.Contains(err.Error(), "cycle") {
+        t.Errorf("error: %v", err)
+    }
+}
+
+type rowItem struct {
+    Kind, Name string
+    Qty        int
+    Text       string
+}
+
+// newDefineTemplate - шаблон с циклом row=Kind и вкладкой шаблонов строк
+func newDefineTemplate() *XlsxTemplateFile {
+    tpl := newTestTemplate([][]string{{"Head"}, {"{{#each Items row=Kind}}"}, {"?", "{{Name}}"}, {"{{/each}}"}, {"Total", "{{sum Items.Qty}}"}})
+    addTestSheet(tpl, [][]string{
+        {"{{#define product}}"}, {"P", "{{Name}}", "{{Qty}}", "{{@number}}"}, {"{{/define}}"},
+        {""},
+        {"{{#define comment}}"}, {"{{Text}}"}, {"  {{../Name}}"}, {"{{/define}}"},
+    })
+    return tpl
+}
+
+var defineData = struct {
+    Name  string
+    Items []rowItem
+}{"Doc", []rowItem{{"product", "A", 2, ""}, {"comment", "", 0, "note"}, {"other", "X", 1, ""}, {"product", "B", 3, ""}}}
+
+func TestRowTemplates(t *testing.T) {
+    tpl := newDefineTemplate()
+    if err := tpl.RenderTemplate(defineData); err != nil {
+        t.Fatal(err)
+    }
+    // Строки элемента - по шаблону его вида, без шаблона - строки цикла
+    checkValues(t, resultValues(tpl.result.Sheets[0]), [][]string{
+        {"Head"},
+        {"P", "A", "2", "1"},
+        {"note"},
+        {"  Doc"},
+        {"?", "X"},
+        {"P", "B", "3", "4"},
+        {"Total", "6"},
+    })
+    // Вкладка шаблонов строк в результат не попадает
+    if len(tpl.result.Sheets) != 1 {
+        t.Errorf("sheets: %d", len(tpl.result.Sheets))
+    }
+    if workbook := resultParts(t, tpl)["xl/workbook.xml"]; strings.Contains(workbook, "Sheet2") {
+        t.Errorf("workbook: %s", workbook)
+    }
+}
+
+func TestRowTemplatesStream(t *testing.T) {
+    var buf bytes.Buffer
+    if err := newDefineTemplate().RenderStream(defineData, &buf); err != nil {
+        t.Fatal(err)
+    }
+    parts := readTestParts(t, buf.Bytes())
+    if _, ok := parts["xl/worksheets/sheet2.xml"]; ok {
+        t.Error("defines sheet written")
+    }
+    // Строки шаблонов шире строк вкладки записываются целиком
+    checkContains(t, parts["xl/worksheets/sheet1.xml"],
+        `<c r="C2" s="1" t="inlineStr"><is><t>2</t></is></c><c r="D2" s="1" t="inlineStr"><is><t>1</t></is></c>`,
+        `<c r="A4" s="1" t="inlineStr"><is><t>  Doc</t></is></c>`,
+        `<c r="D6" s="1" t="inlineStr"><is><t>4</t></is></c>`,
+    )
+}
+
+func TestDuplicateRowTemplate(t *testing.T) {
+    tpl := newTestTemplate([][]string{{"x"}})
+    addTestSheet(tpl, [][]string{{"{{#define a}}"}, {"{{/define}}"}, {"{{#define a}}"}, {"{{/define}}"}})
+    if err := tpl.RenderTemplate(defineData); err == nil || !strings.Contains(err.Error(), "Duplicate") {
+        t.Errorf("error: %v", err)
+    }
+}
@@ -0,0 +1,42 @@
+package xlsxt
+
+import (
+    "regexp"
+    "strconv"
+)
+
+var (
+    rxChartRef   = regexp.MustCompile(`(<(?:\w+:)?f>)([^<]*)(</(?:\w+:)?f>)`)
+    rxChartCache = regexp.MustCompile(`(?s)<(?:\w+:)?(?:numCache|strCache)>.*?</(?:\w+:)?(?:numCache|strCache)>`)
+    rxDrawAnchor = regexp.MustCompile(`(?s)<(?:\w+:)?(?:twoCellAnchor|oneCellAnchor)\b.*?</(?:\w+:)?(?:twoCellAnchor|oneCellAnchor)>`)
+    rxAnchorRow  = regexp.MustCompile(`(?s)(<(?:\w+:)?(from|to)>.*?<(?:\w+:)?row>)(\d+)(</)`)
+)
+
+// mapChart - ссылки рядов диаграммы (c:f) по строкам результата
+// Кэш значений рядов удаляется - Excel заново читает значения из ячеек
+func mapChart(data string, sheets map[string]*rowMap) string {
+    data = rxChartRef.ReplaceAllStringFunc(data, func(f string) string {
+        match := rxChartRef.FindStringSubmatch(f)
+        return match[1] + mapSheetRefs(match[2], sheets) + match[3]
+    })
+    return rxChartCache.ReplaceAllString(data, "")
+}
+
+// mapDrawing - положение рисунков (диаграмм) вкладки по строкам результата
+// Рисунок сдвигается вместе со строкой, к которой привязан его верхний край, размер не меняется
+func mapDrawing(data string, m *rowMap) string {
+    return rxDrawAnchor.ReplaceAllStringFunc(data, func(anchor string) string {
+        delta := 0
+        if match := rxAnchorRow.FindStringSubmatch(anchor); match != nil && match[2] == "from" {
+            row, _ := strconv.Atoi(match[3])
+            if first, _, ok := m.span(row+1, row+1); ok {
+                delta = first - 1 - row
+            }
+        }
+        return rxAnchorRow.ReplaceAllStringFunc(anchor, func(s string) string {
+            match := rxAnchorRow.FindStringSubmatch(s)
+            row, _ := strconv.Atoi(match[3])
+            return match[1] + strconv.Itoa(row+delta) + match[4]
+        })
+    })
+}
@@ -0,0 +1,61 @@
+package xlsxt
+
+import (
+    "strings"
+    "testing"
+)
+
+// openChartTemplate - шаблон отчета с диаграммой по строке элементов, рисунок - ниже итога (строки 6-21)
+func openChartTemplate(t *testing.T) *XlsxTemplateFile {
+    chart := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+        `<c:chartSpace xmlns:c="http://schemas.openxmlformats.org/drawingml/2006/chart"><c:chart><c:plotArea><c:barChart><c:ser>` +
+        `<c:tx><c:strRef><c:f>S1!$B$2</c:f></c:strRef></c:tx>` +
+        `<c:cat><c:strRef><c:f>S1!$A$3:$A$3</c:f><c:strCache><c:ptCount val="1"/></c:strCache></c:strRef></c:cat>` +
+        `<c:val><c:numRef><c:f>S1!$B$3</c:f><c:numCache><c:ptCount val="1"/></c:numCache></c:numRef></c:val>` +
+        `</c:ser></c:barChart></c:plotArea></c:chart></c:chartSpace>`
+    drawing := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+        `<xdr:wsDr xmlns:xdr="http://schemas.openxmlformats.org/drawingml/2006/spreadsheetDrawing"><xdr:twoCellAnchor>` +
+        `<xdr:from><xdr:col>0</xdr:col><xdr:colOff>0</xdr:colOff><xdr:row>5</xdr:row><xdr:rowOff>0</xdr:rowOff></xdr:from>` +
+        `<xdr:to><xdr:col>6</xdr:col><xdr:colOff>0</xdr:colOff><xdr:row>20</xdr:row><xdr:rowOff>0</xdr:rowOff></xdr:to>` +
+        `<xdr:graphicFrame macro=""><xdr:nvGraphicFramePr><xdr:cNvPr id="2" name="Chart 1"/><xdr:cNvGraphicFramePr/></xdr:nvGraphicFramePr>` +
+        `<a:graphic xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main"><a:graphicData uri="http://schemas.openxmlformats.org/drawingml/2006/chart">` +
+        `<c:chart xmlns:c="http://schemas.openxmlformats.org/drawingml/2006/chart" xmlns:r="` + nsRelationships + `" r:id="rId1"/>` +
+        `</a:graphicData></a:graphic></xdr:graphicFrame><xdr:clientData/></xdr:twoCellAnchor></xdr:wsDr>`
+    patch := func(name, data string) string {
+        switch name {
+        case "xl/worksheets/sheet1.xml":
+            return addSheetElement(data, "drawing", `<drawing r:id="rId1"/>`)
+        case "[Content_Types].xml":
+            return addContentTypes(data, map[string]string{
+                "xl/drawings/drawing1.xml": "application/vnd.openxmlformats-officedocument.drawing+xml",
+                "xl/charts/chart1.xml":     chartType,
+            })
+        }
+        return data
+    }
+    return openTestPackage(t, testSheetFile(rangeRows), patch, map[string]string{
+        "xl/charts/chart1.xml":                chart,
+        "xl/drawings/drawing1.xml":            drawing,
+        "xl/drawings/_rels/drawing1.xml.rels": sheetRels([3]string{"rId1", "chart", "../charts/chart1.xml"}),
+        "xl/worksheets/_rels/sheet1.xml.rels": sheetRels([3]string{"rId1", "drawing", "../drawings/drawing1.xml"}),
+    })
+}
+
+func TestChartFollowsRows(t *testing.T) {
+    tpl := openChartTemplate(t)
+    if err := tpl.RenderTemplate(testItems); err != nil {
+        t.Fatal(err)
+    }
+    parts := resultParts(t, tpl)
+    // Ряды - по строкам элементов, кэш значений удален
+    chart := parts["xl/charts/chart1.xml"]
+    checkContains(t, chart, "<c:f>S1!$B$2</c:f>", "<c:f>S1!$A$3:$A$5</c:f>", "<c:f>S1!$B$3:$B$5</c:f>")
+    if strings.Contains(chart, "Cache") {
+        t.Errorf("chart cache: %s", chart)
+    }
+    // Рисунок сдвигается вместе со строками, размер сохраняется
+    checkContains(t, parts["xl/drawings/drawing1.xml"], "<xdr:row>7</xdr:row>", "<xdr:row>22</xdr:row>")
+    checkContains(t, parts["xl/worksheets/sheet1.xml"], `<drawing r:id="`)
+    checkContains(t, parts["[Content_Types].xml"], `PartName="/xl/charts/chart1.xml"`, `PartName="/xl/drawings/drawing1.xml"`)
+    checkContains(t, parts["xl/drawings/_rels/drawing1.xml.rels"], `Target="../charts/chart1.xml"`)
+}
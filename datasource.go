@@ -0,0 +1,185 @@
+package xlsxt
+
+import (
+    "reflect"
+    "strings"
+)
+
+// DataSource - источник данных шаблона
+// Если данные (или вложенное значение) реализуют DataSource, то рендер получает значения
+// через него, а не через reflect. Пути - имена полей через точку (Customer.Name)
+type DataSource interface {
+    // Get - значение по пути, false - если значения нет
+    Get(path string) (interface{}, bool)
+    // Iterate - обход коллекции по пути, nil - если по пути не коллекция
+    Iterate(path string) Iterator
+}
+
+// Iterator - последовательный обход элементов коллекции
+type Iterator interface {
+    // Next - переход к следующему элементу, false - элементов больше нет
+    Next() bool
+    // Value - текущий элемент
+    Value() interface{}
+    // Key - ключ текущего элемента (для карт), nil для списков
+    Key() interface{}
+}
+
+// NewReflectSource - источник данных по умолчанию: обход структур, карт и срезов через reflect
+// Ключи карт обходятся по возрастанию, либо в порядке less
+func NewReflectSource(v interface{}, less func(a, b interface{}) bool) DataSource {
+    return &reflectSource{value: reflect.ValueOf(v), less: less}
+}
+
+// reflectSource - источник данных через reflect
+type reflectSource struct {
+    value reflect.Value
+    less  func(a, b interface{}) bool
+}
+
+// Get (reflectSource)
+func (s *reflectSource) Get(path string) (interface{}, bool) {
+    v, ok := findPath(s.value, splitPath(path))
+    if !ok || !v.IsValid() || !v.CanInterface() {
+        return nil, false
+    }
+    return v.Interface(), true
+}
+
+// Iterate (reflectSource) - срезы и массивы по порядку, карты - в порядке ключей
+func (s *reflectSource) Iterate(path string) Iterator {
+    v, ok := findPath(s.value, splitPath(path))
+    if !ok {
+        return nil
+    }
+    return iterateValue(v, s.less)
+}
+
+// iterateValue - обход значения-коллекции, nil - если значение не коллекция
+func iterateValue(v reflect.Value, less func(a, b interface{}) bool) Iterator {
+    if ds, ok := asDataSource(v); ok {
+        return ds.Iterate("")
+    }
+    if it, ok := asIterator(v); ok {
+        return it
+    }
+    if it := streamIterator(v); it != nil {
+        return it
+    }
+    v = indirect(v)
+    if !v.IsValid() {
+        return nil
+    }
+    it := &sliceIterator{index: -1}
+    switch v.Kind() {
+    case reflect.Slice, reflect.Array:
+        for i := 0; i < v.Len(); i++ {
+            it.items = append(it.items, v.Index(i).Interface())
+        }
+    case reflect.Map:
+        for _, key := range sortMapKeys(v.MapKeys(), less) {
+            it.items = append(it.items, v.MapIndex(key).Interface())
+            it.keys = append(it.keys, key.Interface())
+        }
+    default:
+        return nil
+    }
+    return it
+}
+
+// sliceIterator - обход заранее собранных элементов
+type sliceIterator struct {
+    items, keys []interface{}
+    index       int
+    err         error // ошибка сбора элементов
+}
+
+// NewSliceIterator - итератор по срезу элементов (keys - ключи элементов или nil)
+func NewSliceIterator(items, keys []interface{}) Iterator {
+    return &sliceIterator{items: items, keys: keys, index: -1}
+}
+
+// Next (sliceIterator)
+func (it *sliceIterator) Next() bool {
+    if it.index < len(it.items) {
+        it.index++
+    }
+    return it.index < len(it.items)
+}
+
+// Value (sliceIterator)
+func (it *sliceIterator) Value() interface{} {
+    if it.index < 0 || it.index >= len(it.items) {
+        return nil
+    }
+    return it.items[it.index]
+}
+
+// Len (sliceIterator) - количество элементов
+func (it *sliceIterator) Len() int {
+    return len(it.items)
+}
+
+// Err (sliceIterator) - ошибка сбора элементов
+func (it *sliceIterator) Err() error {
+    return it.err
+}
+
+// Key (sliceIterator)
+func (it *sliceIterator) Key() interface{} {
+    if it.index < 0 || it.index >= len(it.keys) {
+        return nil
+    }
+    return it.keys[it.index]
+}
+
+// sourceOf - источник данных значения: собственный DataSource или обход через reflect
+func sourceOf(v reflect.Value, less func(a, b interface{}) bool) DataSource {
+    if ds, ok := asDataSource(v); ok {
+        return ds
+    }
+    return &reflectSource{value: v, less: less}
+}
+
+// asDataSource - реализует ли значение DataSource
+func asDataSource(v reflect.Value) (DataSource, bool) {
+    for v.IsValid() {
+        if v.CanInterface() {
+            if ds, ok := v.Interface().(DataSource); ok {
+                if v.Kind() == reflect.Ptr && v.IsNil() {
+                    return nil, false
+                }
+                return ds, true
+            }
+        }
+        if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface || v.IsNil() {
+            break
+        }
+        v = v.Elem()
+    }
+    return nil, false
+}
+
+// drainIterator - все элементы итератора и их ключи (nil, если ключей нет)
+func drainIterator(it Iterator) ([]interface{}, []interface{}) {
+    var items, keys []interface{}
+    hasKeys := false
+    for it.Next() {
+        items = append(items, it.Value())
+        key := it.Key()
+        keys = append(keys, key)
+        hasKeys = hasKeys || key != nil
+    }
+    if !hasKeys {
+        keys = nil
+    }
+    return items, keys
+}
+
+// splitPath - путь из имен полей (пустая строка - само значение)
+func splitPath(path string) []string {
+    if len(path) < 1 {
+        return nil
+    }
+    return strings.Split(path, ".")
+}
@@ -0,0 +1,96 @@
+package xlsxt
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+)
+
+// lazySource - источник данных без reflect, считает обращения
+type lazySource struct {
+    calls *int
+    name  string
+    lines []map[string]interface{}
+}
+
+// Get (lazySource)
+func (l lazySource) Get(path string) (interface{}, bool) {
+    *l.calls++
+    switch path {
+    case "Name":
+        return l.name, true
+    case "Total":
+        total := 0.0
+        for _, line := range l.lines {
+            total += line["Amount"].(float64)
+        }
+        return total, true
+    }
+    if strings.HasPrefix(path, "Meta.") {
+        return "meta:" + path[5:], true
+    }
+    return nil, false
+}
+
+// Iterate (lazySource)
+func (l lazySource) Iterate(path string) Iterator {
+    if path != "Lines" {
+        return nil
+    }
+    items := make([]interface{}, len(l.lines))
+    for i := range l.lines {
+        items[i] = l.lines[i]
+    }
+    return NewSliceIterator(items, nil)
+}
+
+func TestDataSource(t *testing.T) {
+    calls := 0
+    data := lazySource{&calls, "doc", []map[string]interface{}{
+        {"Name": "a", "Amount": 1.0, "Kind": "x", "Note": nil},
+        {"Name": "b", "Amount": 5.0, "Kind": "y", "Note": "!"},
+        {"Name": "c", "Amount": 3.0, "Kind": "x", "Note": nil},
+    }}
+    values := renderTestValues(t, [][]string{
+        {"{{Name}}", "{{Total}}", "{{Meta.X}}", "{{Lines:length}}"},
+        {`{{#each Lines sort=-Amount where="Amount > 1"}}`},
+        {"{{@number}}", "{{Name}}", "{{Amount}}", "{{../Name}}"},
+        {"{{/each}}"},
+        {"{{sum Lines.Amount}}", "{{count Lines}}", `{{count Lines where="Note != ''"}}`, `{{count Lines where="Note = '!'"}}`},
+        {"{{#group Lines by=Kind}}"},
+        {"[group-header]{{@key}}", "{{sum Lines.Amount}}"},
+        {"{{/group}}"},
+    }, data)
+    // Пустое значение (nil) соответствует только условию !=
+    checkValues(t, values, [][]string{
+        {"doc", "9", "meta:X", "3"},
+        {"1", "b", "5", "doc"},
+        {"2", "c", "3", "doc"},
+        {"9", "3", "3", "1"},
+        {"x", "4"},
+        {"y", "5"},
+    })
+    if calls < 1 {
+        t.Error("Get not called")
+    }
+}
+
+func TestReflectSource(t *testing.T) {
+    ds := NewReflectSource(map[string]interface{}{"A": []int{1, 2}, "M": map[string]int{"b": 2, "a": 1}}, nil)
+    if v, ok := ds.Get("A"); !ok || fmt.Sprint(v) != "[1 2]" {
+        t.Errorf("A: %v %v", v, ok)
+    }
+    if _, ok := ds.Get("B.C"); ok {
+        t.Error("B.C found")
+    }
+    var keys []string
+    for it := ds.Iterate("M"); it.Next(); {
+        keys = append(keys, fmt.Sprint(it.Key(), "=", it.Value()))
+    }
+    if fmt.Sprint(keys) != "[a=1 b=2]" {
+        t.Errorf("M: %v", keys)
+    }
+    if ds.Iterate("M.a") != nil {
+        t.Error("M.a is not a collection")
+    }
+}
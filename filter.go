@@ -0,0 +1,291 @@
+package xlsxt
+
+import (
+    "fmt"
+    "sort"
+    "time"
+    "regexp"
+    "reflect"
+    "strings"
+    "strconv"
+)
+
+var (
+    rxFilterCondition = regexp.MustCompile(`^\s*([\w\.]+)\s*(==|!=|>=|<=|>|<|=)\s*(.+?)\s*$`)
+)
+
+// filter - условие отбора элементов коллекции (where="Amount > 0 && Status != 'draft'")
+// Группы условий, разделенные ||, объединяются по ИЛИ, условия внутри группы - по И
+type filter struct {
+    groups [][]condition
+}
+
+// condition - одно сравнение поля элемента со значением
+type condition struct {
+    path  []string
+    op    string
+    value string
+}
+
+// parseFilter - разбор выражения фильтра
+func parseFilter(expr string) (*filter, error) {
+    expr = strings.TrimSpace(expr)
+    if len(expr) < 1 {
+        return nil, nil
+    }
+    f := new(filter)
+    for _, group := range strings.Split(expr, "||") {
+        var conditions []condition
+        for _, item := range strings.Split(group, "&&") {
+            item = strings.TrimSpace(item)
+            if len(item) < 1 {
+                return nil, fmt.Errorf("Invalid filter expression: %q", expr)
+            }
+            if match := rxFilterCondition.FindStringSubmatch(item); match != nil {
+                op := match[2]
+                if op == "=" {
+                    op = "=="
+                }
+                conditions = append(conditions, condition{
+                    path:  strings.Split(match[1], "."),
+                    op:    op,
+                    value: unquote(match[3]),
+                })
+            } else if rxFieldPath.MatchString(item) {
+                // Только имя поля - проверяем на "истинность"
+                conditions = append(conditions, condition{path: strings.Split(item, ".")})
+            } else {
+                return nil, fmt.Errorf("Invalid filter condition: %q", item)
+            }
+        }
+        f.groups = append(f.groups, conditions)
+    }
+    return f, nil
+}
+
+// match (filter) - проверка элемента коллекции
+func (f *filter) match(item reflect.Value) bool {
+    if f == nil || len(f.groups) < 1 {
+        return true
+    }
+    for _, group := range f.groups {
+        ok := true
+        for _, c := range group {
+            if !c.match(item) {
+                ok = false
+                break
+            }
+        }
+        if ok {
+            return true
+        }
+    }
+    return false
+}
+
+// match (condition) - проверка одного условия
+// Пустое значение (nil, в том числе из DataSource.Get) соответствует только условию !=
+func (c condition) match(item reflect.Value) bool {
+    v, ok := findPath(item, c.path)
+    if !ok {
+        return false
+    }
+    if len(c.op) < 1 {
+        return isTruthy(v)
+    }
+    if v = indirect(v); !v.IsValid() || !v.CanInterface() {
+        return c.op == "!="
+    }
+    return compareValues(v.Interface(), c.value, c.op)
+}
+
+// sortKey - ключ сортировки элементов коллекции (sort="-Amount,Name")
+type sortKey struct {
+    path []string
+    desc bool
+}
+
+// parseSort - разбор ключей сортировки, "-" перед именем - по убыванию
+func parseSort(expr string) []sortKey {
+    var keys []sortKey
+    for _, item := range strings.Split(expr, ",") {
+        item = strings.TrimSpace(item)
+        key := sortKey{}
+        if strings.HasPrefix(item, "-") {
+            key.desc = true
+            item = strings.TrimSpace(item[1:])
+        } else if strings.HasPrefix(item, "+") {
+            item = strings.TrimSpace(item[1:])
+        }
+        if len(item) > 0 {
+            key.path = strings.Split(item, ".")
+            keys = append(keys, key)
+        }
+    }
+    return keys
+}
+
+// sortItems - устойчивая сортировка элементов коллекции (и их ключей) по ключам сортировки
+// Ключ @key сортирует по ключам карты
+func sortItems(items, keys []interface{}, sortKeys []sortKey) {
+    if len(sortKeys) < 1 {
+        return
+    }
+    sort.Stable(&itemSorter{items: items, keys: keys, sortKeys: sortKeys})
+}
+
+// itemSorter - сортировка элементов вместе с ключами
+type itemSorter struct {
+    items, keys []interface{}
+    sortKeys    []sortKey
+}
+
+func (s *itemSorter) Len() int {
+    return len(s.items)
+}
+
+func (s *itemSorter) Swap(i, j int) {
+    s.items[i], s.items[j] = s.items[j], s.items[i]
+    if s.keys != nil {
+        s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+    }
+}
+
+func (s *itemSorter) Less(i, j int) bool {
+    for _, key := range s.sortKeys {
+        var a, b reflect.Value
+        if len(key.path) == 1 && key.path[0] == "@key" {
+            if s.keys != nil {
+                a, b = reflect.ValueOf(s.keys[i]), reflect.ValueOf(s.keys[j])
+            }
+        } else {
+            a, _ = findPath(reflect.ValueOf(s.items[i]), key.path)
+            b, _ = findPath(reflect.ValueOf(s.items[j]), key.path)
+        }
+        c := compareOrder(a, b)
+        if c == 0 {
+            continue
+        }
+        if key.desc {
+            return c > 0
+        }
+        return c < 0
+    }
+    return false
+}
+
+// compareOrder - порядок двух значений (-1, 0, 1), пустые значения идут первыми
+func compareOrder(a, b reflect.Value) int {
+    a, b = indirect(a), indirect(b)
+    if !a.IsValid() || !b.IsValid() {
+        if a.IsValid() {
+            return 1
+        } else if b.IsValid() {
+            return -1
+        }
+        return 0
+    }
+    if fa, ok := toFloat(a.Interface()); ok {
+        if fb, ok := toFloat(b.Interface()); ok {
+            switch {
+            case fa < fb: return -1
+            case fa > fb: return 1
+            }
+            return 0
+        }
+    }
+    if ta, ok := a.Interface().(time.Time); ok {
+        if tb, ok := b.Interface().(time.Time); ok {
+            switch {
+            case ta.Before(tb): return -1
+            case ta.After(tb):  return 1
+            }
+            return 0
+        }
+    }
+    return strings.Compare(fmt.Sprint(a.Interface()), fmt.Sprint(b.Interface()))
+}
+
+// compareValues - сравнение значения с литералом (числа сравниваются как числа, остальное как строки)
+func compareValues(v interface{}, literal string, op string) bool {
+    if a, ok := toFloat(v); ok {
+        if b, err := strconv.ParseFloat(literal, 64); err == nil {
+            switch op {
+            case "==": return a == b
+            case "!=": return a != b
+            case ">":  return a > b
+            case ">=": return a >= b
+            case "<":  return a < b
+            case "<=": return a <= b
+            }
+            return false
+        }
+    }
+    a := fmt.Sprint(v)
+    switch op {
+    case "==": return a == literal
+    case "!=": return a != literal
+    case ">":  return a > literal
+    case ">=": return a >= literal
+    case "<":  return a < literal
+    case "<=": return a <= literal
+    }
+    return false
+}
+
+// isTruthy - значение считается истинным, если оно не нулевое и не пустое
+func isTruthy(v reflect.Value) bool {
+    for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+        if v.IsNil() {
+            return false
+        }
+        v = v.Elem()
+    }
+    if !v.IsValid() {
+        return false
+    }
+    switch v.Kind() {
+    case reflect.Bool:
+        return v.Bool()
+    case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+        return v.Len() > 0
+    }
+    if f, ok := toFloat(v.Interface()); ok {
+        return f != 0
+    }
+    return true
+}
+
+// unquote - убираем кавычки у строкового литерала
+func unquote(s string) string {
+    if len(s) > 1 {
+        if (s[0] == '\'' && s[len(s)-1] == '\'') || (s[0] == '"' && s[len(s)-1] == '"') {
+            return s[1:len(s)-1]
+        }
+    }
+    return s
+}
+
+// toFloat - приведение числового значения к float64
+func toFloat(v interface{}) (float64, bool) {
+    val := reflect.ValueOf(v)
+    switch val.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return float64(val.Int()), true
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return float64(val.Uint()), true
+    case reflect.Float32, reflect.Float64:
+        return val.Float(), true
+    }
+    return 0, false
+}
+
+// isInteger - является ли значение целым числом
+func isInteger(v interface{}) bool {
+    switch reflect.ValueOf(v).Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return true
+    }
+    return false
+}
@@ -0,0 +1,97 @@
+package xlsxt
+
+import (
+    "io"
+    "fmt"
+    "context"
+    "github.com/tealeg/xlsx"
+)
+
+// RenderOptions - ограничения рендера, 0 - без ограничения
+// Память во время рендера ограничивают MaxRows и MaxCells (и потоковый RenderStream).
+// MaxBytes ограничивает только объем записанного файла: при RenderContext книга целиком
+// собирается в памяти при Write/Save до проверки объема
+type RenderOptions struct {
+    MaxRows   int   // строк результата во всех вкладках
+    MaxCells  int   // ячеек результата во всех вкладках
+    MaxSheets int   // вкладок результата (вкладки только с {{#define}} не считаются)
+    MaxBytes  int64 // объем записанного файла XLSX (байт): RenderStream и Write/Save результата, не память
+}
+
+// LimitError - превышено ограничение рендера
+type LimitError struct {
+    Limit string // rows, cells, sheets, bytes
+    Max   int64
+}
+
+func (e *LimitError) Error() string {
+    return fmt.Sprintf("Render limit exceeded: %s > %d", e.Limit, e.Max)
+}
+
+// renderGuard - проверка отмены и ограничений во время рендера
+type renderGuard struct {
+    ctx   context.Context
+    opts  RenderOptions
+    rows  int
+    cells int
+}
+
+// check (renderGuard) - проверка отмены рендера
+func (g *renderGuard) check() error {
+    if g == nil || g.ctx == nil {
+        return nil
+    }
+    return g.ctx.Err()
+}
+
+// sheets (renderGuard) - проверка количества вкладок
+func (g *renderGuard) sheets(n int) error {
+    if g != nil && g.opts.MaxSheets > 0 && n > g.opts.MaxSheets {
+        return &LimitError{Limit: "sheets", Max: int64(g.opts.MaxSheets)}
+    }
+    return g.check()
+}
+
+// row (renderGuard) - учет строки результата
+func (g *renderGuard) row(row *xlsx.Row) error {
+    if g == nil {
+        return nil
+    }
+    if err := g.check(); err != nil {
+        return err
+    }
+    g.rows++
+    g.cells += len(row.Cells)
+    switch {
+    case g.opts.MaxRows > 0 && g.rows > g.opts.MaxRows:
+        return &LimitError{Limit: "rows", Max: int64(g.opts.MaxRows)}
+    case g.opts.MaxCells > 0 && g.cells > g.opts.MaxCells:
+        return &LimitError{Limit: "cells", Max: int64(g.opts.MaxCells)}
+    }
+    return nil
+}
+
+// limitWriter - запись с ограничением объема (MaxBytes), 0 - без ограничения
+type limitWriter struct {
+    w     io.Writer
+    max   int64
+    bytes int64
+}
+
+// newLimitWriter - writer без обертки, если ограничения нет
+func newLimitWriter(w io.Writer, max int64) io.Writer {
+    if max <= 0 {
+        return w
+    }
+    return &limitWriter{w: w, max: max}
+}
+
+// Write (limitWriter) - превышение объема - ошибка *LimitError, данные сверх него не пишутся
+func (lw *limitWriter) Write(p []byte) (int, error) {
+    if lw.bytes+int64(len(p)) > lw.max {
+        return 0, &LimitError{Limit: "bytes", Max: lw.max}
+    }
+    n, err := lw.w.Write(p)
+    lw.bytes += int64(n)
+    return n, err
+}
@@ -0,0 +1,87 @@
+package xlsxt
+
+import (
+    "time"
+    "context"
+    "testing"
+    "io/ioutil"
+)
+
+var limitRows = [][]string{
+    {"{{Title}}"},
+    {"{{#each Rows}}"},
+    {"{{Name}}", "{{Amount}}"},
+    {"{{/each}}"},
+}
+
+// checkLimit - ошибка *LimitError с нужным ограничением
+func checkLimit(t *testing.T, err error, limit string) {
+    t.Helper()
+    if e, ok := err.(*LimitError); !ok || e.Limit != limit {
+        t.Errorf("%s: %v", limit, err)
+    }
+}
+
+func TestRenderLimits(t *testing.T) {
+    tpl := newTestTemplate(limitRows)
+    checkLimit(t, tpl.RenderContext(context.Background(), newStreamDoc(100), RenderOptions{MaxRows: 50}), "rows")
+    if tpl.result != nil {
+        t.Error("result after limit")
+    }
+    checkLimit(t, tpl.RenderContext(context.Background(), newStreamDoc(100), RenderOptions{MaxCells: 20}), "cells")
+    if err := tpl.RenderContext(context.Background(), newStreamDoc(10), RenderOptions{MaxRows: 11, MaxCells: 21}); err != nil {
+        t.Error(err)
+    }
+    checkLimit(t, tpl.RenderStreamContext(context.Background(), newStreamDoc(100), ioutil.Discard, RenderOptions{MaxRows: 50}), "rows")
+}
+
+func TestMaxSheets(t *testing.T) {
+    // Вкладка только с {{#define}} - не вкладка результата
+    tpl := newTestTemplate(limitRows)
+    addTestSheet(tpl, [][]string{{"{{#define line}}"}, {"{{Name}}"}, {"{{/define}}"}})
+    if err := tpl.RenderContext(context.Background(), newStreamDoc(3), RenderOptions{MaxSheets: 1}); err != nil {
+        t.Error(err)
+    }
+    addTestSheet(tpl, [][]string{{"{{Title}}"}})
+    checkLimit(t, tpl.RenderContext(context.Background(), newStreamDoc(3), RenderOptions{MaxSheets: 1}), "sheets")
+    checkLimit(t, tpl.RenderStreamContext(context.Background(), newStreamDoc(3), ioutil.Discard, RenderOptions{MaxSheets: 1}), "sheets")
+}
+
+func TestMaxBytes(t *testing.T) {
+    // Объем проверяется при записи результата
+    tpl := newTestTemplate(limitRows)
+    if err := tpl.RenderContext(context.Background(), newStreamDoc(100), RenderOptions{MaxBytes: 100}); err != nil {
+        t.Fatal(err)
+    }
+    checkLimit(t, tpl.Write(ioutil.Discard), "bytes")
+    checkLimit(t, tpl.RenderStreamContext(context.Background(), newStreamDoc(100), ioutil.Discard, RenderOptions{MaxBytes: 100}), "bytes")
+    if err := tpl.RenderContext(context.Background(), newStreamDoc(100), RenderOptions{MaxBytes: 1 << 20}); err != nil {
+        t.Fatal(err)
+    }
+    if err := tpl.Write(ioutil.Discard); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestRenderCancel(t *testing.T) {
+    // Бесконечная последовательность прерывается отменой
+    doc := &streamDoc{Title: "x", Rows: func(yield func(interface{}) bool) {
+        for {
+            time.Sleep(time.Millisecond)
+            if !yield(streamRow{"a", 1}) {
+                return
+            }
+        }
+    }}
+    tpl := newTestTemplate(limitRows)
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    if err := tpl.RenderContext(ctx, doc, RenderOptions{}); err != context.DeadlineExceeded || tpl.result != nil {
+        t.Errorf("render: %v", err)
+    }
+    ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    if err := tpl.RenderStreamContext(ctx, doc, ioutil.Discard, RenderOptions{}); err != context.DeadlineExceeded {
+        t.Errorf("stream: %v", err)
+    }
+}
@@ -0,0 +1,84 @@
+package xlsxt
+
+import (
+    "regexp"
+    "strconv"
+    "strings"
+    "github.com/tealeg/xlsx"
+)
+
+var (
+    rxOutlinePr = regexp.MustCompile(`(?s)<outlinePr\b[^>]*?(?:/>|>.*?</outlinePr>)`)
+    rxTabColor  = regexp.MustCompile(`(?s)<tabColor\b[^>]*?(?:/>|>.*?</tabColor>)`)
+)
+
+// maxOutlineLevel - максимальный уровень структуры строк xlsx
+const maxOutlineLevel = 7
+
+// Outline - группировка строк вложенных коллекций (структура Excel)
+type Outline int
+
+const (
+    OutlineNone         Outline = iota // без группировки
+    OutlineSummaryAbove                // строки элемента внешней коллекции (итоги) над вложенными строками
+    OutlineSummaryBelow                // итоговые строки под вложенными строками
+)
+
+// SetOutline (XlsxTemplateFile) - группировка строк по вложенности коллекций: строки вложенной
+// коллекции (строки заказов внутри заказа) получают уровень структуры на единицу больше внешней
+func (s *XlsxTemplateFile) SetOutline(outline Outline) {
+    s.outline = outline
+}
+
+// outlineLevel - уровень структуры строки по глубине вложенности коллекций (с единицы)
+func outlineLevel(depth int) uint8 {
+    switch {
+    case depth <= 1:
+        return 0
+    case depth-1 > maxOutlineLevel:
+        return maxOutlineLevel
+    }
+    return uint8(depth-1)
+}
+
+// patchOutline - расположение итоговых строк структуры (outlinePr) в настройках вкладок
+func patchOutline(parts map[string]string, file *xlsx.File, outline Outline) {
+    if outline == OutlineNone {
+        return
+    }
+    below := "0"
+    if outline == OutlineSummaryBelow {
+        below = "1"
+    }
+    element := `<outlinePr summaryBelow="` + below + `"/>`
+    for i := range file.Sheets {
+        name := "xl/worksheets/sheet" + strconv.Itoa(i+1) + ".xml"
+        data, ok := parts[name]
+        if !ok {
+            continue
+        }
+        sheetPr := "<sheetPr>" + element + "</sheetPr>"
+        for _, e := range xmlElements(data) {
+            if e.name == "sheetPr" {
+                sheetPr = withOutlinePr(data[e.start:e.end], element)
+            }
+        }
+        parts[name] = setElement(data, worksheetOrder, "sheetPr", sheetPr)
+    }
+}
+
+// withOutlinePr - элемент sheetPr с outlinePr вместо прежнего (после tabColor)
+func withOutlinePr(sheetPr, element string) string {
+    sheetPr = rxOutlinePr.ReplaceAllString(sheetPr, "")
+    open := strings.Index(sheetPr, ">")
+    if open < 1 {
+        return sheetPr
+    }
+    if sheetPr[open-1] == '/' {
+        return sheetPr[:open-1] + ">" + element + "</sheetPr>"
+    }
+    if loc := rxTabColor.FindStringIndex(sheetPr); loc != nil {
+        open = loc[1]-1
+    }
+    return sheetPr[:open+1] + element + sheetPr[open+1:]
+}
@@ -0,0 +1,70 @@
+package xlsxt
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+)
+
+var outlineRows = [][]string{
+    {"Head"},
+    {"{{#each Orders}}"},
+    {"{{Number}}"},
+    {"{{#each Lines}}"},
+    {"{{Name}}"},
+    {"{{/each}}"},
+    {"{{/each}}"},
+    {"{{Orders.Lines.Name}}"},
+}
+
+// outlineLevels - уровни структуры строк вкладки результата
+func outlineLevels(tpl *XlsxTemplateFile) []uint8 {
+    var levels []uint8
+    for _, row := range tpl.result.Sheets[0].Rows {
+        levels = append(levels, row.OutlineLevel)
+    }
+    return levels
+}
+
+func TestOutlineLevels(t *testing.T) {
+    tpl := newTestTemplate(outlineRows)
+    tpl.SetOutline(OutlineSummaryAbove)
+    if err := tpl.RenderTemplate(loopData); err != nil {
+        t.Fatal(err)
+    }
+    // Строки заказа - уровень 0, строки позиций - 1 (в строке без блока - по вложенности коллекций)
+    if levels := fmt.Sprint(outlineLevels(tpl)); levels != "[0 0 1 1 0 1 1 1 1]" {
+        t.Errorf("levels: %s", levels)
+    }
+    // Пустая вложенная коллекция - строка внешней коллекции
+    tpl = newTestTemplate([][]string{{"[{{Orders.Number}}]", "{{Orders.Lines.Name}}"}})
+    tpl.SetOutline(OutlineSummaryAbove)
+    data := loopData
+    data.Orders = append(append([]loopOrder{}, data.Orders...), loopOrder{Number: "C-3"})
+    if err := tpl.RenderTemplate(data); err != nil {
+        t.Fatal(err)
+    }
+    if levels := fmt.Sprint(outlineLevels(tpl)); levels != "[1 1 1 0]" {
+        t.Errorf("levels: %s", levels)
+    }
+}
+
+func TestOutlineSummary(t *testing.T) {
+    tpl := openSheetTemplate(t, outlineRows, map[string]string{"sheetPr": `<sheetPr><tabColor rgb="FFFF0000"/></sheetPr>`}, "")
+    tpl.SetOutline(OutlineSummaryAbove)
+    if err := tpl.RenderTemplate(loopData); err != nil {
+        t.Fatal(err)
+    }
+    sheet := resultParts(t, tpl)["xl/worksheets/sheet1.xml"]
+    checkContains(t, sheet, `<sheetPr><tabColor rgb="FFFF0000"/><outlinePr summaryBelow="0"/></sheetPr>`, `outlineLevelRow="1"`, `outlineLevel="1"`)
+    tpl.SetOutline(OutlineSummaryBelow)
+    checkContains(t, resultParts(t, tpl)["xl/worksheets/sheet1.xml"], `<outlinePr summaryBelow="1"/>`)
+    // Без группировки уровни не задаются
+    tpl.SetOutline(OutlineNone)
+    if err := tpl.RenderTemplate(loopData); err != nil {
+        t.Fatal(err)
+    }
+    if sheet := resultParts(t, tpl)["xl/worksheets/sheet1.xml"]; strings.Contains(sheet, "outline") {
+        t.Errorf("sheet: %s", sheet)
+    }
+}
@@ -0,0 +1,592 @@
+package xlsxt
+
+import (
+    "io"
+    "os"
+    "sort"
+    "bytes"
+    "regexp"
+    "strings"
+    "strconv"
+    "io/ioutil"
+    "archive/zip"
+    "encoding/xml"
+    "path"
+    "github.com/tealeg/xlsx"
+)
+
+var (
+    rxPrefixedAttr = regexp.MustCompile(`\s+[\w\-]+:[\w\-]+\s*=\s*("[^"]*"|'[^']*')`)
+    rxCountAttr    = regexp.MustCompile(`\scount="\d*"`)
+    rxRefAttr      = regexp.MustCompile(`\sref="([^"]*)"`)
+    rxSqrefAttr    = regexp.MustCompile(`\ssqref="([^"]*)"`)
+    rxFormulaText  = regexp.MustCompile(`(<formula\d?>)([^<]*)(</formula\d?>)`)
+)
+
+// sheetSettings - элементы настроек вкладки, которые переносятся из шаблона в результат
+// (tealeg/xlsx их не читает и пишет значения по умолчанию)
+var sheetSettings = []string{
+    "sheetPr", "sheetViews", "autoFilter", "conditionalFormatting", "dataValidations",
+    "printOptions", "pageMargins", "pageSetup", "headerFooter", "rowBreaks", "colBreaks", "drawing", "tableParts",
+}
+
+// relElements - элементы вкладки со ссылками (r:id) на связанные части, которые переносятся в результат
+var relElements = map[string]bool{"drawing": true, "tableParts": true}
+
+// relTypes - типы связанных частей вкладки, которые переносятся в результат (со всеми их связями)
+var relTypes = map[string]bool{"drawing": true, "table": true}
+
+const (
+    nsRelationships = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+    nsPackageRels   = "http://schemas.openxmlformats.org/package/2006/relationships"
+    chartType       = "application/vnd.openxmlformats-officedocument.drawingml.chart+xml"
+)
+
+// worksheetOrder - порядок элементов worksheet (CT_Worksheet)
+var worksheetOrder = []string{
+    "sheetPr", "dimension", "sheetViews", "sheetFormatPr", "cols", "sheetData", "sheetCalcPr",
+    "sheetProtection", "protectedRanges", "scenarios", "autoFilter", "sortState", "dataConsolidate",
+    "customSheetViews", "mergeCells", "phoneticPr", "conditionalFormatting", "dataValidations",
+    "hyperlinks", "printOptions", "pageMargins", "pageSetup", "headerFooter", "rowBreaks", "colBreaks",
+    "customProperties", "cellWatches", "ignoredErrors", "smartTags", "drawing", "legacyDrawing",
+    "legacyDrawingHF", "picture", "oleObjects", "controls", "webPublishItems", "tableParts", "extLst",
+}
+
+// stylesOrder - порядок элементов styleSheet (CT_Stylesheet)
+var stylesOrder = []string{
+    "numFmts", "fonts", "fills", "borders", "cellStyleXfs", "cellXfs", "cellStyles", "dxfs", "tableStyles", "colors", "extLst",
+}
+
+// templateParts - части xlsx шаблона, которые не читает tealeg/xlsx
+type templateParts struct {
+    // sheets - вкладки шаблона (по порядку вкладок)
+    sheets []*sheetPart
+    // names - имена книги
+    names []definedName
+    // dxfs - форматы условного форматирования
+    dxfs string
+    // files - связанные части вкладок (таблицы, рисунки, диаграммы) и их связи: путь -> содержимое
+    files map[string]string
+    // types, defaults - типы содержимого связанных частей: по пути и по расширению
+    types, defaults map[string]string
+}
+
+// sheetPart - части вкладки шаблона
+type sheetPart struct {
+    name     string
+    elements map[string][]string // XML элементов вкладки: имя элемента -> XML
+    rels     []partRel           // связи вкладки с переносимыми частями
+    tables   []*tableInfo
+    drawings []string            // рисунки вкладки (диаграммы)
+    rich     map[string][]templateRun // ячейки с форматированным текстом: адрес -> фрагменты
+}
+
+// partRel - связь части пакета (Relationship)
+type partRel struct {
+    XMLName    xml.Name `xml:"Relationship"`
+    Id         string   `xml:"Id,attr"`
+    Type       string   `xml:"Type,attr"`
+    Target     string   `xml:"Target,attr"`
+    TargetMode string   `xml:"TargetMode,attr,omitempty"`
+}
+
+// sheet (templateParts) - части вкладки шаблона по имени (nil - нет)
+func (p *templateParts) sheet(name string) *sheetPart {
+    if p != nil {
+        for _, sp := range p.sheets {
+            if sp.name == name {
+                return sp
+            }
+        }
+    }
+    return nil
+}
+
+// definedName - имя книги (definedName в workbook.xml)
+type definedName struct {
+    XMLName      xml.Name   `xml:"definedName"`
+    Name         string     `xml:"name,attr"`
+    LocalSheetID *int       `xml:"localSheetId,attr"`
+    Attrs        []xml.Attr `xml:",any,attr"`
+    Value        string     `xml:",chardata"`
+}
+
+// xmlElement - элемент верхнего уровня XML документа и его положение
+type xmlElement struct {
+    name       string
+    start, end int
+}
+
+// readTemplateParts - чтение частей шаблона из xlsx файла
+func readTemplateParts(filename string) (*templateParts, error) {
+    reader, err := zip.OpenReader(filename)
+    if err != nil {
+        return nil, err
+    }
+    defer reader.Close()
+    files := make(map[string]*zip.File, len(reader.File))
+    for _, f := range reader.File {
+        files[f.Name] = f
+    }
+    read := func(name string) string {
+        f, ok := files[name]
+        if !ok {
+            return ""
+        }
+        rc, err := f.Open()
+        if err != nil {
+            return ""
+        }
+        defer rc.Close()
+        data, _ := ioutil.ReadAll(rc)
+        return string(data)
+    }
+    var workbook struct {
+        Sheets []struct {
+            Name string     `xml:"name,attr"`
+            Attrs []xml.Attr `xml:",any,attr"`
+        } `xml:"sheets>sheet"`
+        Names []definedName `xml:"definedNames>definedName"`
+    }
+    if err := xml.Unmarshal([]byte(read("xl/workbook.xml")), &workbook); err != nil {
+        return nil, err
+    }
+    targets := make(map[string]string)
+    var shared [][]templateRun
+    for _, rel := range readRels(read, "xl/workbook.xml") {
+        targets[rel.Id] = partPath("xl", rel.Target)
+        if path.Base(rel.Type) == "sharedStrings" {
+            shared = readSharedRuns(read(targets[rel.Id]))
+        }
+    }
+    parts := &templateParts{
+        names:    workbook.Names,
+        files:    make(map[string]string),
+        types:    make(map[string]string),
+        defaults: make(map[string]string),
+    }
+    var types struct {
+        Defaults []struct {
+            Extension   string `xml:"Extension,attr"`
+            ContentType string `xml:"ContentType,attr"`
+        } `xml:"Default"`
+        Overrides []struct {
+            PartName    string `xml:"PartName,attr"`
+            ContentType string `xml:"ContentType,attr"`
+        } `xml:"Override"`
+    }
+    xml.Unmarshal([]byte(read("[Content_Types].xml")), &types)
+    for _, d := range types.Defaults {
+        parts.defaults[strings.ToLower(d.Extension)] = d.ContentType
+    }
+    for _, o := range types.Overrides {
+        parts.types[strings.TrimPrefix(o.PartName, "/")] = o.ContentType
+    }
+    // Связанная часть со всеми ее связями
+    var collect func(part string)
+    collect = func(part string) {
+        if _, ok := parts.files[part]; ok {
+            return
+        }
+        parts.files[part] = read(part)
+        if rels := read(relsPath(part)); len(rels) > 0 {
+            parts.files[relsPath(part)] = rels
+            for _, rel := range readRels(read, part) {
+                if rel.TargetMode != "External" {
+                    collect(partPath(path.Dir(part), rel.Target))
+                }
+            }
+        }
+    }
+    styles := read("xl/styles.xml")
+    for _, e := range xmlElements(styles) {
+        if e.name == "dxfs" {
+            parts.dxfs = styles[e.start:e.end]
+        }
+    }
+    for _, sheet := range workbook.Sheets {
+        sp := &sheetPart{name: sheet.Name, elements: make(map[string][]string)}
+        for _, attr := range sheet.Attrs {
+            if attr.Name.Local != "id" {
+                continue
+            }
+            name := targets[attr.Value]
+            data := read(name)
+            for _, e := range xmlElements(data) {
+                sp.elements[e.name] = append(sp.elements[e.name], data[e.start:e.end])
+            }
+            sp.rich = readRichCells(data, shared)
+            for _, rel := range readRels(read, name) {
+                kind := path.Base(rel.Type)
+                if !relTypes[kind] || rel.TargetMode == "External" {
+                    continue
+                }
+                target := partPath(path.Dir(name), rel.Target)
+                collect(target)
+                sp.rels = append(sp.rels, rel)
+                switch kind {
+                case "table":
+                    if table := readTable(target, parts.files[target]); table != nil {
+                        sp.tables = append(sp.tables, table)
+                    }
+                case "drawing":
+                    sp.drawings = append(sp.drawings, target)
+                }
+            }
+        }
+        parts.sheets = append(parts.sheets, sp)
+    }
+    return parts, nil
+}
+
+// readRels - связи части пакета
+func readRels(read func(string) string, part string) []partRel {
+    var rels struct {
+        Relationships []partRel `xml:"Relationship"`
+    }
+    xml.Unmarshal([]byte(read(relsPath(part))), &rels)
+    return rels.Relationships
+}
+
+// relsPath - путь к связям части пакета
+func relsPath(part string) string {
+    return path.Join(path.Dir(part), "_rels", path.Base(part)+".rels")
+}
+
+// partPath - путь части пакета по ссылке target относительно каталога dir
+func partPath(dir, target string) string {
+    if strings.HasPrefix(target, "/") {
+        return strings.TrimPrefix(target, "/")
+    }
+    return path.Clean(path.Join(dir, target))
+}
+
+// xmlElements - дочерние элементы корня XML документа
+// Элементы с префиксом пространства имен пропускаются (их нельзя перенести в другой документ)
+func xmlElements(data string) []xmlElement {
+    var elements []xmlElement
+    decoder := xml.NewDecoder(strings.NewReader(data))
+    depth, start := 0, 0
+    for {
+        offset := int(decoder.InputOffset())
+        token, err := decoder.RawToken()
+        if err != nil {
+            break
+        }
+        switch t := token.(type) {
+        case xml.StartElement:
+            depth++
+            if depth == 2 {
+                start = offset
+            }
+        case xml.EndElement:
+            if depth == 2 && len(t.Name.Space) < 1 {
+                elements = append(elements, xmlElement{name: t.Name.Local, start: start, end: int(decoder.InputOffset())})
+            }
+            depth--
+        }
+    }
+    return elements
+}
+
+// setElement - замена элемента корня XML документа (или вставка с учетом порядка элементов order)
+func setElement(data string, order []string, name, element string) string {
+    index := func(name string) int {
+        for i, n := range order {
+            if n == name {
+                return i
+            }
+        }
+        return len(order)
+    }
+    for _, e := range xmlElements(data) {
+        if e.name == name {
+            return data[:e.start] + element + data[e.end:]
+        }
+        if index(e.name) > index(name) {
+            return data[:e.start] + element + data[e.start:]
+        }
+    }
+    if i := strings.LastIndex(data, "</"); i >= 0 {
+        return data[:i] + element + data[i:]
+    }
+    return data
+}
+
+// patch (templateParts) - перенос настроек вкладок и имен шаблона в части результата
+// template - вкладки шаблона, file - записываемые вкладки, rows - строки результата по строкам шаблона
+// (nil - строки совпадают с шаблоном)
+func (p *templateParts) patch(parts map[string]string, template, file *xlsx.File, rows []*rowMap) error {
+    if p == nil {
+        return nil
+    }
+    // Строки результата по именам вкладок - для ссылок диаграмм и имен книги
+    sheets := make(map[string]*rowMap, len(template.Sheets))
+    for i, sheet := range template.Sheets {
+        sheets[sheet.Name] = sheetRowMap(rows, i)
+    }
+    for name, data := range p.files {
+        if p.types[name] == chartType {
+            data = mapChart(data, sheets)
+        }
+        parts[name] = data
+        p.addContentType(parts, name)
+    }
+    // Вкладки результата сопоставляются вкладкам шаблона по имени (вкладки шаблонов строк не выводятся)
+    for i, sheet := range file.Sheets {
+        sp := p.sheet(sheet.Name)
+        if sp == nil {
+            continue
+        }
+        m := sheets[sheet.Name]
+        name := "xl/worksheets/sheet" + strconv.Itoa(i+1) + ".xml"
+        data, ok := parts[name]
+        if !ok {
+            continue
+        }
+        for _, setting := range sheetSettings {
+            elements, ok := sp.elements[setting]
+            if !ok {
+                continue
+            }
+            var buf bytes.Buffer
+            for _, element := range elements {
+                // Ссылки на другие части (настройки принтера) не переносятся
+                if !relElements[setting] {
+                    element = rxPrefixedAttr.ReplaceAllString(element, "")
+                }
+                buf.WriteString(mapSheetElement(setting, element, m))
+            }
+            data = setElement(data, worksheetOrder, setting, buf.String())
+        }
+        if len(sp.rels) > 0 {
+            data = addRootNamespace(data, "r", nsRelationships)
+            rels, err := xml.Marshal(struct {
+                XMLName       xml.Name  `xml:"Relationships"`
+                Xmlns         string    `xml:"xmlns,attr"`
+                Relationships []partRel
+            }{Xmlns: nsPackageRels, Relationships: sp.rels})
+            if err != nil {
+                return err
+            }
+            parts[relsPath(name)] = xml.Header + string(rels)
+        }
+        for _, table := range sp.tables {
+            parts[table.path] = table.mapXML(p.files[table.path], m)
+        }
+        for _, drawing := range sp.drawings {
+            parts[drawing] = mapDrawing(p.files[drawing], m)
+        }
+        parts[name] = data
+    }
+    if len(p.dxfs) > 0 {
+        parts["xl/styles.xml"] = setElement(parts["xl/styles.xml"], stylesOrder, "dxfs", p.dxfs)
+    }
+    return p.patchNames(parts, template, file, sheets)
+}
+
+// addContentType (templateParts) - тип содержимого перенесенной части в [Content_Types].xml
+func (p *templateParts) addContentType(parts map[string]string, name string) {
+    types := parts["[Content_Types].xml"]
+    var entry string
+    if contentType, ok := p.types[name]; ok {
+        entry = `<Override PartName="/` + xmlEscape(name) + `" ContentType="` + xmlEscape(contentType) + `"/>`
+    } else {
+        ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+        contentType, ok := p.defaults[ext]
+        if !ok || strings.Contains(strings.ToLower(types), `extension="`+ext+`"`) {
+            return
+        }
+        entry = `<Default Extension="` + xmlEscape(ext) + `" ContentType="` + xmlEscape(contentType) + `"/>`
+    }
+    if i := strings.LastIndex(types, "</Types>"); i >= 0 {
+        parts["[Content_Types].xml"] = types[:i] + entry + types[i:]
+    }
+}
+
+// addRootNamespace - объявление префикса пространства имен в корневом элементе XML документа
+func addRootNamespace(data, prefix, ns string) string {
+    elements := xmlElements(data)
+    if len(elements) < 1 {
+        return data
+    }
+    root := strings.LastIndex(data[:elements[0].start], "<")
+    open := data[root:elements[0].start]
+    if strings.Contains(open, "xmlns:"+prefix+"=") {
+        return data
+    }
+    if i := strings.Index(open, " "); i >= 0 {
+        return data[:root+i] + ` xmlns:` + prefix + `="` + ns + `"` + data[root+i:]
+    }
+    return data
+}
+
+// xmlEscape - экранирование текста для XML
+func xmlEscape(s string) string {
+    var buf bytes.Buffer
+    xml.EscapeText(&buf, []byte(s))
+    return buf.String()
+}
+
+// sheetRowMap - строки результата вкладки (nil - строки совпадают с шаблоном)
+func sheetRowMap(rows []*rowMap, sheet int) *rowMap {
+    if sheet < len(rows) {
+        return rows[sheet]
+    }
+    return nil
+}
+
+// mapSheetElement - диапазоны элемента вкладки по строкам результата ("" - элемент не нужен)
+func mapSheetElement(name, element string, m *rowMap) string {
+    switch name {
+    case "autoFilter":
+        element, _ = mapRefAttr(element, rxRefAttr, m)
+    case "conditionalFormatting":
+        element, _ = mapRefAttr(element, rxSqrefAttr, m)
+    case "dataValidations":
+        children := xmlElements(element)
+        if len(children) < 1 {
+            return ""
+        }
+        var buf bytes.Buffer
+        count := 0
+        for _, child := range children {
+            if mapped, ok := mapRefAttr(element[child.start:child.end], rxSqrefAttr, m); ok {
+                buf.WriteString(mapped)
+                count++
+            }
+        }
+        if count < 1 {
+            return ""
+        }
+        open := rxCountAttr.ReplaceAllString(element[:children[0].start], ` count="`+strconv.Itoa(count)+`"`)
+        element = open + buf.String() + element[children[len(children)-1].end:]
+    }
+    return element
+}
+
+// mapRefAttr - диапазон атрибута rx (первого в элементе) и формулы элемента по строкам результата
+// false - строк диапазона в результате нет
+func mapRefAttr(element string, rx *regexp.Regexp, m *rowMap) (string, bool) {
+    loc := rx.FindStringSubmatchIndex(element)
+    if loc == nil {
+        return element, true
+    }
+    ref := element[loc[2]:loc[3]]
+    mapped, ok := m.mapSqref(ref)
+    if !ok {
+        return "", false
+    }
+    // Сдвиг первой строки диапазона - для относительных ссылок в формулах
+    delta := 0
+    from := rxCellRef.FindStringSubmatch(strings.SplitN(ref, ":", 2)[0])
+    to := rxCellRef.FindStringSubmatch(strings.SplitN(mapped, ":", 2)[0])
+    if from != nil && to != nil {
+        a, _ := strconv.Atoi(from[3])
+        b, _ := strconv.Atoi(to[3])
+        delta = b - a
+    }
+    element = element[:loc[2]] + mapped + element[loc[3]:]
+    return rxFormulaText.ReplaceAllStringFunc(element, func(formula string) string {
+        match := rxFormulaText.FindStringSubmatch(formula)
+        return match[1] + m.mapFormula(match[2], delta) + match[3]
+    }), true
+}
+
+// patchNames (templateParts) - имена книги (именованные диапазоны, области печати) в workbook.xml
+// Диапазоны вкладок растягиваются на строки результата (sheets - по именам вкладок шаблона),
+// имена вкладок, которых нет в результате, не переносятся
+func (p *templateParts) patchNames(parts map[string]string, template, file *xlsx.File, sheets map[string]*rowMap) error {
+    index := make(map[string]int, len(file.Sheets))
+    for i, sheet := range file.Sheets {
+        index[sheet.Name] = i
+    }
+    var buf bytes.Buffer
+    for _, name := range p.names {
+        if sheet := name.LocalSheetID; sheet != nil {
+            if *sheet >= len(template.Sheets) {
+                continue
+            }
+            i, ok := index[template.Sheets[*sheet].Name]
+            if !ok {
+                continue
+            }
+            name.LocalSheetID = &i
+        }
+        if refersMissingSheet(name.Value, template, index) {
+            continue
+        }
+        name.Value = mapSheetRefs(name.Value, sheets)
+        name.XMLName = xml.Name{}
+        data, err := xml.Marshal(name)
+        if err != nil {
+            return err
+        }
+        buf.Write(data)
+    }
+    if buf.Len() < 1 {
+        return nil
+    }
+    // tealeg/xlsx пишет пустой definedNames
+    workbook := parts["xl/workbook.xml"]
+    if i := strings.Index(workbook, "<definedNames>"); i >= 0 {
+        i += len("<definedNames>")
+        parts["xl/workbook.xml"] = workbook[:i] + buf.String() + workbook[i:]
+    } else if i := strings.Index(workbook, "</sheets>"); i >= 0 {
+        i += len("</sheets>")
+        parts["xl/workbook.xml"] = workbook[:i] + "<definedNames>" + buf.String() + "</definedNames>" + workbook[i:]
+    }
+    return nil
+}
+
+// refersMissingSheet - ссылается ли формула на вкладку шаблона, которой нет в результате
+func refersMissingSheet(text string, template *xlsx.File, index map[string]int) bool {
+    for _, match := range rxSheetRef.FindAllStringSubmatch(text, -1) {
+        name := strings.TrimSuffix(match[1], "!")
+        if strings.HasPrefix(name, "'") {
+            name = strings.Replace(strings.Trim(name, "'"), "''", "'", -1)
+        }
+        if _, ok := index[name]; ok {
+            continue
+        }
+        for _, sheet := range template.Sheets {
+            if sheet.Name == name {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// writeParts - запись частей xlsx пакета в zip архив
+func writeParts(parts map[string]string, writer io.Writer) error {
+    names := make([]string, 0, len(parts))
+    for name := range parts {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    zipWriter := zip.NewWriter(writer)
+    for _, name := range names {
+        w, err := zipWriter.Create(name)
+        if err != nil {
+            return err
+        }
+        if _, err := io.WriteString(w, parts[name]); err != nil {
+            return err
+        }
+    }
+    return zipWriter.Close()
+}
+
+// saveFile - запись в файл через функцию write
+func saveFile(filename string, write func(io.Writer) error) error {
+    f, err := os.Create(filename)
+    if err != nil {
+        return err
+    }
+    if err := write(f); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
@@ -0,0 +1,236 @@
+package xlsxt
+
+import (
+    "io"
+    "bytes"
+    "strings"
+    "testing"
+    "io/ioutil"
+    "archive/zip"
+    "path/filepath"
+    "github.com/tealeg/xlsx"
+)
+
+// openTestPackage - шаблон из файла, части пакета которого правит patch (имя части, XML),
+// extra - новые части пакета
+func openTestPackage(t *testing.T, file *xlsx.File, patch func(name, data string) string, extra map[string]string) *XlsxTemplateFile {
+    var buf bytes.Buffer
+    if err := file.Write(&buf); err != nil {
+        t.Fatal(err)
+    }
+    parts := readTestParts(t, buf.Bytes())
+    for name, data := range parts {
+        if patch != nil {
+            parts[name] = patch(name, data)
+        }
+    }
+    for name, data := range extra {
+        parts[name] = data
+    }
+    filename := filepath.Join(t.TempDir(), "template.xlsx")
+    if err := saveFile(filename, func(w io.Writer) error { return writeParts(parts, w) }); err != nil {
+        t.Fatal(err)
+    }
+    tpl, err := OpenTemplate(filename)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return tpl
+}
+
+// readTestParts - части пакета xlsx
+func readTestParts(t *testing.T, data []byte) map[string]string {
+    reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    parts := make(map[string]string)
+    for _, f := range reader.File {
+        rc, err := f.Open()
+        if err != nil {
+            t.Fatal(err)
+        }
+        b, err := ioutil.ReadAll(rc)
+        rc.Close()
+        if err != nil {
+            t.Fatal(err)
+        }
+        parts[f.Name] = string(b)
+    }
+    return parts
+}
+
+// resultParts - части пакета записанного результата
+func resultParts(t *testing.T, tpl *XlsxTemplateFile) map[string]string {
+    var buf bytes.Buffer
+    if err := tpl.Write(&buf); err != nil {
+        t.Fatal(err)
+    }
+    return readTestParts(t, buf.Bytes())
+}
+
+// addSheetElement - элемент вкладки со ссылкой на связанную часть (r:id)
+func addSheetElement(data, name, element string) string {
+    data = strings.Replace(data, "<worksheet ", `<worksheet xmlns:r="`+nsRelationships+`" `, 1)
+    return setElement(data, worksheetOrder, name, element)
+}
+
+// sheetRels - связи вкладки (Id -> Type, Target)
+func sheetRels(rels ...[3]string) string {
+    var b strings.Builder
+    b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?><Relationships xmlns="` + nsPackageRels + `">`)
+    for _, rel := range rels {
+        b.WriteString(`<Relationship Id="` + rel[0] + `" Type="` + nsRelationships + `/` + rel[1] + `" Target="` + rel[2] + `"/>`)
+    }
+    b.WriteString(`</Relationships>`)
+    return b.String()
+}
+
+// addContentTypes - типы содержимого новых частей пакета
+func addContentTypes(data string, overrides map[string]string) string {
+    var b strings.Builder
+    for name, contentType := range overrides {
+        b.WriteString(`<Override PartName="/` + name + `" ContentType="` + contentType + `"/>`)
+    }
+    return strings.Replace(data, "</Types>", b.String()+"</Types>", 1)
+}
+
+// openSheetTemplate - шаблон из строк ячеек, elements - элементы вкладки (имя -> XML),
+// names - имена книги (definedNames)
+func openSheetTemplate(t *testing.T, rows [][]string, elements map[string]string, names string) *XlsxTemplateFile {
+    return openTestPackage(t, testSheetFile(rows), func(name, data string) string {
+        return patchTestSheet(name, data, elements, names)
+    }, nil)
+}
+
+// testSheetFile - книга с одной вкладкой S1 из строк ячеек
+func testSheetFile(rows [][]string) *xlsx.File {
+    file := xlsx.NewFile()
+    sheet, _ := file.AddSheet("S1")
+    for _, values := range rows {
+        row := sheet.AddRow()
+        for _, value := range values {
+            row.AddCell().Value = value
+        }
+    }
+    return file
+}
+
+// patchTestSheet - элементы вкладки S1 и имена книги в частях пакета
+func patchTestSheet(name, data string, elements map[string]string, names string) string {
+    switch name {
+    case "xl/worksheets/sheet1.xml":
+        for element, xml := range elements {
+            data = setElement(data, worksheetOrder, element, xml)
+        }
+    case "xl/workbook.xml":
+        if len(names) > 0 {
+            data = strings.Replace(data, "</sheets>", "</sheets><definedNames>"+names+"</definedNames>", 1)
+        }
+    }
+    return data
+}
+
+// checkContains - части результата содержат фрагменты XML
+func checkContains(t *testing.T, data string, fragments ...string) {
+    t.Helper()
+    for _, fragment := range fragments {
+        if !strings.Contains(data, fragment) {
+            t.Errorf("no %s in:\n%s", fragment, data)
+        }
+    }
+}
+
+var testItems = struct{ Items []tableOrder }{[]tableOrder{{"a", 1}, {"b", 200}, {"c", 3}}}
+
+func TestSheetSettings(t *testing.T) {
+    settings := map[string]string{
+        "sheetPr":      `<sheetPr><tabColor rgb="FFFF0000"/><pageSetUpPr fitToPage="1"/></sheetPr>`,
+        "sheetViews":   `<sheetViews><sheetView showGridLines="0" zoomScale="85" workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`,
+        "pageMargins":  `<pageMargins left="0.3" right="0.5" top="0.75" bottom="0.75" header="0.3" footer="0.3"/>`,
+        "pageSetup":    `<pageSetup orientation="landscape" fitToWidth="1" fitToHeight="0"/>`,
+        "headerFooter": `<headerFooter><oddFooter>&amp;CPage &amp;P</oddFooter></headerFooter>`,
+    }
+    tpl := openSheetTemplate(t, [][]string{{"Name"}, {"{{Items.Name}}"}}, settings, "")
+    if err := tpl.RenderTemplate(testItems); err != nil {
+        t.Fatal(err)
+    }
+    sheet := resultParts(t, tpl)["xl/worksheets/sheet1.xml"]
+    for _, element := range settings {
+        checkContains(t, sheet, element)
+    }
+    // Элементы идут в порядке схемы
+    if strings.Index(sheet, "<sheetViews>") > strings.Index(sheet, "<sheetData") ||
+        strings.Index(sheet, "<pageSetup ") > strings.Index(sheet, "<headerFooter>") {
+        t.Errorf("order: %s", sheet)
+    }
+}
+
+// rangeRows - шаблон отчета: заголовок, строка элементов и строка итога
+var rangeRows = [][]string{{"Report"}, {"Name", "Qty"}, {"{{Items.Name}}", "{{Items.Qty}}"}, {"Total", "{{sum Items.Qty}}"}}
+
+// rangeElements - автофильтр, условное форматирование и проверки данных по строкам шаблона
+var rangeElements = map[string]string{
+    "autoFilter": `<autoFilter ref="A2:B3"/>`,
+    "conditionalFormatting": `<conditionalFormatting sqref="A3:B3"><cfRule type="expression" dxfId="0" priority="1"><formula>$B3&gt;100</formula></cfRule></conditionalFormatting>` +
+        `<conditionalFormatting sqref="B4"><cfRule type="cellIs" dxfId="0" priority="2" operator="greaterThan"><formula>SUM($B$3:$B$3)</formula></cfRule></conditionalFormatting>`,
+    "dataValidations": `<dataValidations count="2"><dataValidation type="list" allowBlank="1" sqref="A3"><formula1>"a,b,c"</formula1></dataValidation>` +
+        `<dataValidation type="whole" sqref="B3 D10:D20"><formula1>0</formula1><formula2>$B$1</formula2></dataValidation></dataValidations>`,
+}
+
+// openRangeTemplate - шаблон отчета с диапазонами и стилем условного форматирования (dxfs)
+func openRangeTemplate(t *testing.T) *XlsxTemplateFile {
+    return openTestPackage(t, testSheetFile(rangeRows), func(name, data string) string {
+        if name == "xl/styles.xml" {
+            return setElement(data, stylesOrder, "dxfs", `<dxfs count="1"><dxf><font><color rgb="FF9C0006"/></font></dxf></dxfs>`)
+        }
+        return patchTestSheet(name, data, rangeElements, "")
+    }, nil)
+}
+
+func TestRangesFollowRows(t *testing.T) {
+    tpl := openRangeTemplate(t)
+    if err := tpl.RenderTemplate(testItems); err != nil {
+        t.Fatal(err)
+    }
+    // Диапазоны строки элементов растягиваются, диапазоны ниже - сдвигаются
+    parts := resultParts(t, tpl)
+    checkContains(t, parts["xl/worksheets/sheet1.xml"],
+        `<autoFilter ref="A2:B5"/>`,
+        `<conditionalFormatting sqref="A3:B5">`,
+        `<formula>$B3&gt;100</formula>`,
+        `<conditionalFormatting sqref="B6">`,
+        `<formula>SUM($B$3:$B$5)</formula>`,
+        `<dataValidations count="2">`,
+        `sqref="A3:A5"`,
+        `sqref="B3:B5 D12:D22"`,
+    )
+    checkContains(t, parts["xl/styles.xml"], `<dxfs count="1"><dxf><font><color rgb="FF9C0006"/></font></dxf></dxfs>`)
+}
+
+func TestRangesOfEmptyCollection(t *testing.T) {
+    tpl := openRangeTemplate(t)
+    if err := tpl.RenderTemplate(struct{ Items []tableOrder }{}); err != nil {
+        t.Fatal(err)
+    }
+    // Диапазоны только по строкам элементов удаляются
+    sheet := resultParts(t, tpl)["xl/worksheets/sheet1.xml"]
+    checkContains(t, sheet, `<autoFilter ref="A2:B2"/>`, `<dataValidations count="1">`, `sqref="D9:D19"`)
+    if strings.Contains(sheet, `"a,b,c"`) || strings.Contains(sheet, "$B3&gt;100") {
+        t.Errorf("sheet: %s", sheet)
+    }
+}
+
+func TestDefinedNames(t *testing.T) {
+    names := `<definedName name="_xlnm.Print_Area" localSheetId="0">S1!$A$1:$B$4</definedName>` +
+        `<definedName name="Items">S1!$A$3:$B$3</definedName><definedName name="TotalCell">S1!$B$4</definedName>`
+    tpl := openSheetTemplate(t, rangeRows, nil, names)
+    if err := tpl.RenderTemplate(testItems); err != nil {
+        t.Fatal(err)
+    }
+    checkContains(t, resultParts(t, tpl)["xl/workbook.xml"],
+        `<definedName name="_xlnm.Print_Area" localSheetId="0">S1!$A$1:$B$6</definedName>`,
+        `<definedName name="Items">S1!$A$3:$B$5</definedName>`,
+        `<definedName name="TotalCell">S1!$B$6</definedName>`,
+    )
+}
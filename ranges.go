@@ -0,0 +1,216 @@
+package xlsxt
+
+import (
+    "regexp"
+    "strings"
+    "strconv"
+    "github.com/tealeg/xlsx"
+)
+
+var (
+    rxCellRef       = regexp.MustCompile(`^(\$?[A-Za-z]{1,3})?(\$?)(\d+)$`)
+    rxFormulaRef    = regexp.MustCompile(`\$?[A-Za-z]{1,3}\$?\d+(?::\$?[A-Za-z]{1,3}\$?\d+)?`)
+    rxFormulaString = regexp.MustCompile(`&quot;.*?&quot;|"[^"]*"|'[^']*'`)
+    rxSheetRef      = regexp.MustCompile(`((?:'(?:[^']|'')+'|[\p{L}\w\.]+)!)(\$?[A-Za-z]{1,3}\$?\d+(?::\$?[A-Za-z]{1,3}\$?\d+)?|\$?\d+:\$?\d+)`)
+)
+
+// maxSheetRows - максимальное количество строк вкладки xlsx
+const maxSheetRows = 1048576
+
+// rowMap - строки результата, полученные из строк шаблона
+type rowMap struct {
+    index map[*xlsx.Row]int
+    rows  [][2]int // первая и последняя строка результата по строкам шаблона (-1 - строк нет)
+    total int      // количество строк результата
+}
+
+// newRowMap - пустое соответствие строк для строк шаблона
+func newRowMap(rows []*xlsx.Row) *rowMap {
+    m := &rowMap{index: make(map[*xlsx.Row]int, len(rows)), rows: make([][2]int, len(rows))}
+    for i, row := range rows {
+        m.index[row] = i
+        m.rows[i] = [2]int{-1, -1}
+    }
+    return m
+}
+
+// add (rowMap) - строка результата (с нуля) получена из строки шаблона
+func (m *rowMap) add(row *xlsx.Row, result int) {
+    if m == nil {
+        return
+    }
+    if i, ok := m.index[row]; ok {
+        if m.rows[i][0] < 0 {
+            m.rows[i][0] = result
+        }
+        m.rows[i][1] = result
+    }
+    if result >= m.total {
+        m.total = result + 1
+    }
+}
+
+// alias (rowMap) - строки результата из row считаются строками результата строки шаблона as
+func (m *rowMap) alias(row, as *xlsx.Row) {
+    if m == nil {
+        return
+    }
+    if i, ok := m.index[as]; ok {
+        m.index[row] = i
+    }
+}
+
+// span (rowMap) - первая и последняя строки результата для строк шаблона from..to (с единицы)
+// Строки ниже шаблона сдвигаются на количество добавленных строк, false - строк в результате нет
+func (m *rowMap) span(from, to int) (int, int, bool) {
+    if m == nil {
+        return from, to, true
+    }
+    first, last := 0, 0
+    n := len(m.rows)
+    for r := from; r <= to && r <= n; r++ {
+        if m.rows[r-1][0] < 0 {
+            continue
+        }
+        if first < 1 {
+            first = m.rows[r-1][0] + 1
+        }
+        last = m.rows[r-1][1] + 1
+    }
+    if to > n {
+        shift := m.total - n
+        if first < 1 {
+            if from > n {
+                first = from + shift
+            } else {
+                first = n + 1 + shift
+            }
+        }
+        last = to + shift
+        if last > maxSheetRows {
+            last = maxSheetRows
+        }
+    }
+    return first, last, first > 0 && first <= last
+}
+
+// mapRange (rowMap) - диапазон (A1:B2, $3:$3, A1) по строкам результата
+// Диапазоны без строк ($A:$C) не меняются, false - строк диапазона в результате нет
+func (m *rowMap) mapRange(ref string) (string, bool) {
+    sides := strings.SplitN(ref, ":", 2)
+    from := rxCellRef.FindStringSubmatch(sides[0])
+    if from == nil {
+        return ref, true
+    }
+    to := from
+    if len(sides) > 1 {
+        if to = rxCellRef.FindStringSubmatch(sides[1]); to == nil {
+            return ref, true
+        }
+    }
+    r1, _ := strconv.Atoi(from[3])
+    r2, _ := strconv.Atoi(to[3])
+    first, last, ok := m.span(r1, r2)
+    if !ok {
+        return "", false
+    }
+    result := from[1] + from[2] + strconv.Itoa(first)
+    if len(sides) > 1 || first != last {
+        result += ":" + to[1] + to[2] + strconv.Itoa(last)
+    }
+    return result, true
+}
+
+// mapSqref (rowMap) - список диапазонов через пробел (sqref) по строкам результата
+func (m *rowMap) mapSqref(sqref string) (string, bool) {
+    var refs []string
+    for _, ref := range strings.Fields(sqref) {
+        if mapped, ok := m.mapRange(ref); ok {
+            refs = append(refs, mapped)
+        }
+    }
+    return strings.Join(refs, " "), len(refs) > 0
+}
+
+// mapFormula (rowMap) - ссылки формулы (XML текст) по строкам результата
+// Относительные строки сдвигаются на delta (смещение первой ячейки диапазона правила),
+// абсолютные - переносятся на строки результата. Строки в кавычках и ссылки на другие вкладки не меняются
+func (m *rowMap) mapFormula(formula string, delta int) string {
+    var buf strings.Builder
+    last := 0
+    for _, loc := range rxFormulaString.FindAllStringIndex(formula, -1) {
+        buf.WriteString(m.mapFormulaRefs(formula[last:loc[0]], delta))
+        buf.WriteString(formula[loc[0]:loc[1]])
+        last = loc[1]
+    }
+    buf.WriteString(m.mapFormulaRefs(formula[last:], delta))
+    return buf.String()
+}
+
+// mapFormulaRefs (rowMap) - ссылки части формулы без строк в кавычках
+func (m *rowMap) mapFormulaRefs(text string, delta int) string {
+    isName := func(c byte) bool {
+        return c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+    }
+    var buf strings.Builder
+    last := 0
+    for _, loc := range rxFormulaRef.FindAllStringIndex(text, -1) {
+        // Часть имени функции или ссылка на другую вкладку
+        if loc[0] > 0 && (isName(text[loc[0]-1]) || text[loc[0]-1] == '!') {
+            continue
+        }
+        if loc[1] < len(text) && (isName(text[loc[1]]) || text[loc[1]] == '(') {
+            continue
+        }
+        buf.WriteString(text[last:loc[0]])
+        sides := strings.Split(text[loc[0]:loc[1]], ":")
+        refs := make([][]string, len(sides))
+        rows := make([]int, len(sides))
+        for i, side := range sides {
+            refs[i] = rxCellRef.FindStringSubmatch(side)
+            rows[i], _ = strconv.Atoi(refs[i][3])
+        }
+        first, end, ok := m.span(rows[0], rows[len(rows)-1])
+        for i, ref := range refs {
+            row := rows[i]
+            switch {
+            case len(ref[2]) < 1:
+                row += delta
+            case ok && i == 0:
+                row = first
+            case ok:
+                row = end
+            }
+            if row < 1 {
+                row = 1
+            }
+            if i > 0 {
+                buf.WriteString(":")
+            }
+            buf.WriteString(ref[1] + ref[2] + strconv.Itoa(row))
+        }
+        last = loc[1]
+    }
+    buf.WriteString(text[last:])
+    return buf.String()
+}
+
+// mapSheetRefs - ссылки на вкладки (Лист!A1:B2, 'Лист 1'!$3:$3) по строкам результата
+// sheets - строки результата по именам вкладок шаблона, ссылки на другие вкладки не меняются
+func mapSheetRefs(text string, sheets map[string]*rowMap) string {
+    return rxSheetRef.ReplaceAllStringFunc(text, func(ref string) string {
+        match := rxSheetRef.FindStringSubmatch(ref)
+        name := strings.TrimSuffix(match[1], "!")
+        if strings.HasPrefix(name, "'") {
+            name = strings.Replace(strings.Trim(name, "'"), "''", "'", -1)
+        }
+        m, ok := sheets[name]
+        if !ok {
+            return ref
+        }
+        if mapped, ok := m.mapRange(match[2]); ok {
+            return match[1] + mapped
+        }
+        return ref
+    })
+}
@@ -0,0 +1,571 @@
+package xlsxt
+
+import (
+    "math"
+    "regexp"
+    "strconv"
+    "strings"
+    "encoding/xml"
+    "github.com/tealeg/xlsx"
+    "github.com/aymerick/raymond"
+)
+
+// Метки фрагментов форматированного текста в значении ячейки (символы из области частного использования):
+// richRun + шрифт + richSep - фрагмент шаблона (шрифт целиком),
+// richSpan + шрифт + richSep - фрагмент хелпера rich (поверх шрифта фрагмента шаблона), richEnd - конец фрагмента хелпера
+const (
+    richRun   = "\uE000"
+    richSep   = "\uE001"
+    richSpan  = "\uE002"
+    richEnd   = "\uE003"
+    richMarks = richRun + richSep + richSpan + richEnd
+)
+
+var rxSheetCell = regexp.MustCompile(`(?s)<c r="([A-Z]+\d+)"([^>]*?)(?:/>|>.*?</c>)`)
+
+func init() {
+    // {{rich Comment}} - разметка **жирный**, *курсив*, __подчеркнутый__ в значении,
+    // {{rich Amount color="FFFF0000"}} - цвет всего значения
+    raymond.RegisterHelper("rich", func(value interface{}, options *raymond.Options) raymond.SafeString {
+        return raymond.SafeString(richMarkdown(raymond.Str(value), options.HashStr("color")))
+    })
+}
+
+// textRun - фрагмент текста ячейки со своим шрифтом
+type textRun struct {
+    Text string
+    Font xlsx.Font
+}
+
+// richText - фрагменты ячеек результата с форматированным текстом
+type richText map[*xlsx.Cell][]textRun
+
+// runProps - свойства фрагмента общей строки шаблона (rPr)
+type runProps struct {
+    Bold      *xmlVal `xml:"b"`
+    Italic    *xmlVal `xml:"i"`
+    Underline *xmlVal `xml:"u"`
+    Size      *xmlVal `xml:"sz"`
+    Color     *struct {
+        RGB string `xml:"rgb,attr"`
+    } `xml:"color"`
+    Font      *xmlVal `xml:"rFont"`
+    Family    *xmlVal `xml:"family"`
+    Charset   *xmlVal `xml:"charset"`
+}
+
+// xmlVal - элемент со значением в атрибуте val
+type xmlVal struct {
+    Val string `xml:"val,attr"`
+}
+
+// on (xmlVal) - включен ли флаг (<b/>, <b val="1"/>)
+func (v *xmlVal) on() bool {
+    return v != nil && v.Val != "0" && v.Val != "false" && v.Val != "none"
+}
+
+// templateRun - фрагмент общей строки шаблона
+type templateRun struct {
+    Text  string     `xml:"t"`
+    Props *runProps  `xml:"rPr"`
+}
+
+// font (runProps) - шрифт фрагмента, незаданные свойства берутся из шрифта ячейки
+func (p *runProps) font(base xlsx.Font) xlsx.Font {
+    if p == nil {
+        return base
+    }
+    font := base
+    font.Bold, font.Italic, font.Underline = p.Bold.on(), p.Italic.on(), p.Underline.on()
+    if p.Size != nil {
+        if size, err := strconv.ParseFloat(p.Size.Val, 64); err == nil {
+            font.Size = int(math.Round(size))
+        }
+    }
+    if p.Color != nil && len(p.Color.RGB) > 0 {
+        font.Color = p.Color.RGB
+    }
+    if p.Font != nil {
+        font.Name = p.Font.Val
+    }
+    if p.Family != nil {
+        font.Family, _ = strconv.Atoi(p.Family.Val)
+    }
+    if p.Charset != nil {
+        font.Charset, _ = strconv.Atoi(p.Charset.Val)
+    }
+    return font
+}
+
+// readSharedRuns - фрагменты общих строк (sharedStrings.xml), nil - строка без фрагментов
+func readSharedRuns(data string) [][]templateRun {
+    var sst struct {
+        Items []struct {
+            Runs []templateRun `xml:"r"`
+        } `xml:"si"`
+    }
+    xml.Unmarshal([]byte(data), &sst)
+    shared := make([][]templateRun, len(sst.Items))
+    for i, item := range sst.Items {
+        if len(item.Runs) > 1 {
+            shared[i] = item.Runs
+        }
+    }
+    return shared
+}
+
+// readRichCells - ячейки вкладки с форматированными общими строками: адрес ячейки -> фрагменты
+func readRichCells(data string, shared [][]templateRun) map[string][]templateRun {
+    cells := make(map[string][]templateRun)
+    decoder := xml.NewDecoder(strings.NewReader(data))
+    var ref string
+    inValue := false
+    for {
+        token, err := decoder.Token()
+        if err != nil {
+            break
+        }
+        switch t := token.(type) {
+        case xml.StartElement:
+            switch t.Name.Local {
+            case "c":
+                ref = ""
+                var kind string
+                for _, attr := range t.Attr {
+                    switch attr.Name.Local {
+                    case "r":
+                        ref = attr.Value
+                    case "t":
+                        kind = attr.Value
+                    }
+                }
+                if kind != "s" {
+                    ref = ""
+                }
+            case "v":
+                inValue = len(ref) > 0
+            }
+        case xml.CharData:
+            if inValue {
+                if i, err := strconv.Atoi(strings.TrimSpace(string(t))); err == nil && i >= 0 && i < len(shared) && shared[i] != nil {
+                    cells[ref] = shared[i]
+                }
+            }
+        case xml.EndElement:
+            if t.Name.Local == "v" {
+                inValue = false
+            }
+        }
+    }
+    return cells
+}
+
+// applyTemplateRuns - фрагменты форматированного текста шаблона переносятся в значения ячеек метками,
+// чтобы выражения внутри фрагмента получили его шрифт. Строки-директивы блоков не меняются
+func applyTemplateRuns(file *xlsx.File, parts *templateParts) {
+    for _, sheet := range file.Sheets {
+        sp := parts.sheet(sheet.Name)
+        if sp == nil || len(sp.rich) < 1 {
+            continue
+        }
+        for y, row := range sheet.Rows {
+            for x, cell := range row.Cells {
+                runs, ok := sp.rich[xlsx.GetCellIDStringFromCoords(x, y)]
+                if !ok {
+                    continue
+                }
+                base := cellFont(cell)
+                var value strings.Builder
+                var fonts []xlsx.Font
+                var texts []string
+                for _, run := range runs {
+                    font := run.Props.font(base)
+                    // Выражение, разбитое на несколько фрагментов, остается в первом из них
+                    if n := len(texts); n > 0 && (fonts[n-1] == font || strings.Count(texts[n-1], "{{") > strings.Count(texts[n-1], "}}")) {
+                        texts[n-1] += run.Text
+                        continue
+                    }
+                    fonts, texts = append(fonts, font), append(texts, run.Text)
+                }
+                plain := strings.Join(texts, "")
+                if len(texts) < 2 || rxBlockOpen.MatchString(plain) || rxBlockClose.MatchString(plain) || rxBlockElse.MatchString(plain) {
+                    continue
+                }
+                for i, text := range texts {
+                    value.WriteString(richRun + fontSpec(fonts[i]) + richSep + text)
+                }
+                cell.Value = value.String()
+            }
+        }
+    }
+}
+
+// richMarkdown - значение хелпера rich: фрагменты по разметке **жирный**, *курсив*, __подчеркнутый__
+// (\* - символ без разметки), color - цвет всех фрагментов (ARGB)
+func richMarkdown(text, color string) string {
+    var out, current strings.Builder
+    bold, italic, underline := false, false, false
+    spans := 0
+    flush := func() {
+        if current.Len() < 1 {
+            return
+        }
+        var spec []string
+        if bold {
+            spec = append(spec, "b")
+        }
+        if italic {
+            spec = append(spec, "i")
+        }
+        if underline {
+            spec = append(spec, "u")
+        }
+        if len(color) > 0 {
+            spec = append(spec, "c="+color)
+        }
+        if len(spec) > 0 {
+            out.WriteString(richSpan + strings.Join(spec, ";") + richSep)
+            spans++
+        } else {
+            out.WriteString(richEnd)
+        }
+        out.WriteString(current.String())
+        current.Reset()
+    }
+    toggles := []struct {
+        mark string
+        flag *bool
+    }{{"**", &bold}, {"__", &underline}, {"*", &italic}}
+next:
+    for i := 0; i < len(text); {
+        if text[i] == '\\' && i+1 < len(text) && (text[i+1] == '*' || text[i+1] == '_') {
+            current.WriteByte(text[i+1])
+            i += 2
+            continue
+        }
+        for _, t := range toggles {
+            // Разметка без пары - обычный текст
+            if strings.HasPrefix(text[i:], t.mark) && (*t.flag || strings.Contains(text[i+len(t.mark):], t.mark)) {
+                flush()
+                *t.flag = !*t.flag
+                i += len(t.mark)
+                continue next
+            }
+        }
+        current.WriteByte(text[i])
+        i++
+    }
+    flush()
+    if spans < 1 {
+        return strings.Replace(out.String(), richEnd, "", -1)
+    }
+    return out.String() + richEnd
+}
+
+// fontSpec - шрифт фрагмента в метке
+func fontSpec(font xlsx.Font) string {
+    var spec []string
+    if font.Bold {
+        spec = append(spec, "b")
+    }
+    if font.Italic {
+        spec = append(spec, "i")
+    }
+    if font.Underline {
+        spec = append(spec, "u")
+    }
+    if font.Size > 0 {
+        spec = append(spec, "sz="+strconv.Itoa(font.Size))
+    }
+    if len(font.Color) > 0 {
+        spec = append(spec, "c="+font.Color)
+    }
+    if len(font.Name) > 0 {
+        spec = append(spec, "n="+font.Name)
+    }
+    if font.Family > 0 {
+        spec = append(spec, "f="+strconv.Itoa(font.Family))
+    }
+    if font.Charset > 0 {
+        spec = append(spec, "cs="+strconv.Itoa(font.Charset))
+    }
+    return strings.Join(spec, ";")
+}
+
+// parseFontSpec - шрифт из метки поверх шрифта base
+func parseFontSpec(spec string, base xlsx.Font) xlsx.Font {
+    font := base
+    for _, token := range strings.Split(spec, ";") {
+        kv := strings.SplitN(token, "=", 2)
+        switch kv[0] {
+        case "b":
+            font.Bold = true
+        case "i":
+            font.Italic = true
+        case "u":
+            font.Underline = true
+        }
+        if len(kv) < 2 {
+            continue
+        }
+        switch kv[0] {
+        case "sz":
+            font.Size, _ = strconv.Atoi(kv[1])
+        case "c":
+            font.Color = kv[1]
+        case "n":
+            font.Name = kv[1]
+        case "f":
+            font.Family, _ = strconv.Atoi(kv[1])
+        case "cs":
+            font.Charset, _ = strconv.Atoi(kv[1])
+        }
+    }
+    return font
+}
+
+// decodeRich - текст без меток и фрагменты значения ячейки (nil - у всего текста шрифт ячейки base)
+func decodeRich(value string, base xlsx.Font) (string, []textRun) {
+    var runs []textRun
+    var plain strings.Builder
+    runFont, font := base, base
+    add := func(text string) {
+        if len(text) < 1 {
+            return
+        }
+        plain.WriteString(text)
+        if n := len(runs); n > 0 && runs[n-1].Font == font {
+            runs[n-1].Text += text
+            return
+        }
+        runs = append(runs, textRun{Text: text, Font: font})
+    }
+    for len(value) > 0 {
+        i := strings.IndexAny(value, richMarks)
+        if i < 0 {
+            add(value)
+            break
+        }
+        add(value[:i])
+        value = value[i:]
+        switch {
+        case strings.HasPrefix(value, richRun), strings.HasPrefix(value, richSpan):
+            end := strings.Index(value, richSep)
+            if end < 0 {
+                end = len(value)
+            }
+            spec := value[len(richRun):end]
+            if strings.HasPrefix(value, richRun) {
+                runFont = parseFontSpec(spec, xlsx.Font{})
+                font = runFont
+            } else {
+                font = parseFontSpec(spec, runFont)
+            }
+            value = strings.TrimPrefix(value[end:], richSep)
+        case strings.HasPrefix(value, richEnd):
+            font = runFont
+            value = value[len(richEnd):]
+        default:
+            value = value[len(richSep):]
+        }
+    }
+    if len(runs) < 2 && (len(runs) < 1 || runs[0].Font == base) {
+        return plain.String(), nil
+    }
+    return plain.String(), runs
+}
+
+// cellFont - шрифт стиля ячейки
+func cellFont(cell *xlsx.Cell) xlsx.Font {
+    if style := cell.GetStyle(); style != nil {
+        return style.Font
+    }
+    return xlsx.Font{}
+}
+
+// cellRichText - текст и фрагменты ячейки: из фрагментов результата или меток в значении (ячейки шаблона)
+func cellRichText(cell *xlsx.Cell, rich richText) (string, []textRun) {
+    if runs, ok := rich[cell]; ok {
+        return cell.Value, runs
+    }
+    if strings.ContainsAny(cell.Value, richMarks) {
+        return decodeRich(cell.Value, cellFont(cell))
+    }
+    return cell.Value, nil
+}
+
+// extractRich - метки фрагментов убираются из значений ячеек строки, фрагменты сохраняются в rich
+// (nil - фрагменты не сохраняются, например при потоковой записи)
+func extractRich(row *xlsx.Row, rich richText) {
+    for _, cell := range row.Cells {
+        if cell == nil || !strings.ContainsAny(cell.Value, richMarks) {
+            continue
+        }
+        var runs []textRun
+        cell.Value, runs = decodeRich(cell.Value, cellFont(cell))
+        if runs != nil && rich != nil {
+            rich[cell] = runs
+        }
+    }
+}
+
+// patchRich - ячейки с фрагментами записываются строками с форматированием (inlineStr)
+func patchRich(parts map[string]string, file *xlsx.File, rich richText) {
+    for i, sheet := range file.Sheets {
+        cells := make(map[string][]textRun)
+        for y, row := range sheet.Rows {
+            for x, cell := range row.Cells {
+                if _, runs := cellRichText(cell, rich); runs != nil {
+                    cells[xlsx.GetCellIDStringFromCoords(x, y)] = runs
+                }
+            }
+        }
+        name := "xl/worksheets/sheet" + strconv.Itoa(i+1) + ".xml"
+        data, ok := parts[name]
+        if len(cells) < 1 || !ok {
+            continue
+        }
+        parts[name] = rxSheetCell.ReplaceAllStringFunc(data, func(c string) string {
+            match := rxSheetCell.FindStringSubmatch(c)
+            runs, ok := cells[match[1]]
+            if !ok {
+                return c
+            }
+            var buf strings.Builder
+            buf.WriteString(`<c r="` + match[1] + `"` + rxTypeAttr.ReplaceAllString(match[2], "") + ` t="inlineStr"><is>`)
+            for _, run := range runs {
+                buf.WriteString(runXML(run))
+            }
+            buf.WriteString(`</is></c>`)
+            return buf.String()
+        })
+    }
+}
+
+var rxTypeAttr = regexp.MustCompile(`\st="[^"]*"`)
+
+// runXML - фрагмент строки с форматированием (r)
+func runXML(run textRun) string {
+    var props strings.Builder
+    if len(run.Font.Name) > 0 {
+        props.WriteString(`<rFont val="` + xmlEscape(run.Font.Name) + `"/>`)
+    }
+    if run.Font.Charset > 0 {
+        props.WriteString(`<charset val="` + strconv.Itoa(run.Font.Charset) + `"/>`)
+    }
+    if run.Font.Family > 0 {
+        props.WriteString(`<family val="` + strconv.Itoa(run.Font.Family) + `"/>`)
+    }
+    if run.Font.Bold {
+        props.WriteString(`<b/>`)
+    }
+    if run.Font.Italic {
+        props.WriteString(`<i/>`)
+    }
+    if len(run.Font.Color) > 0 {
+        props.WriteString(`<color rgb="` + xmlEscape(run.Font.Color) + `"/>`)
+    }
+    if run.Font.Size > 0 {
+        props.WriteString(`<sz val="` + strconv.Itoa(run.Font.Size) + `"/>`)
+    }
+    if run.Font.Underline {
+        props.WriteString(`<u/>`)
+    }
+    result := "<r>"
+    if props.Len() > 0 {
+        result += "<rPr>" + props.String() + "</rPr>"
+    }
+    return result + `<t xml:space="preserve">` + xmlEscape(run.Text) + "</t></r>"
+}
+
+// htmlRuns - фрагменты ячейки в HTML
+func htmlRuns(runs []textRun) string {
+    html := ""
+    for _, run := range runs {
+        html += "<font"
+        if len(run.Font.Name) > 0 {
+            html += " face=\""+run.Font.Name+"\""
+        }
+        if len(run.Font.Color) >= 6 {
+            html += " color=\"#"+run.Font.Color[len(run.Font.Color)-6:]+"\""
+        }
+        html += ">"
+        if run.Font.Bold {
+            html += "<b>"
+        }
+        if run.Font.Italic {
+            html += "<i>"
+        }
+        if run.Font.Underline {
+            html += "<u>"
+        }
+        html += run.Text
+        if run.Font.Underline {
+            html += "</u>"
+        }
+        if run.Font.Italic {
+            html += "</i>"
+        }
+        if run.Font.Bold {
+            html += "</b>"
+        }
+        html += "</font>"
+    }
+    return html
+}
+
+// runStyle - стиль ячейки со шрифтом фрагмента (для PDF)
+func runStyle(style *xlsx.Style, font xlsx.Font) *xlsx.Style {
+    result := xlsx.NewStyle()
+    if style != nil {
+        *result = *style
+    }
+    result.Font = font
+    return result
+}
+
+// wrapRuns - разбиение фрагментов на строки шириной не больше width по словам
+// measure - ширина текста шрифтом фрагмента
+func wrapRuns(runs []textRun, width float64, measure func(font xlsx.Font, text string) float64) [][]textRun {
+    var lines [][]textRun
+    var line []textRun
+    lineWidth := 0.0
+    for _, run := range runs {
+        for i, word := range strings.Split(run.Text, " ") {
+            // Первое слово фрагмента продолжает последнее слово предыдущего
+            text := word
+            if i > 0 && len(line) > 0 {
+                text = " " + word
+            }
+            w := measure(run.Font, text)
+            if i > 0 && len(line) > 0 && lineWidth+w > width {
+                lines = append(lines, line)
+                line, lineWidth = nil, 0.0
+                text = word
+                w = measure(run.Font, text)
+            }
+            if n := len(line); n > 0 && line[n-1].Font == run.Font {
+                line[n-1].Text += text
+            } else {
+                line = append(line, textRun{Text: text, Font: run.Font})
+            }
+            lineWidth += w
+        }
+    }
+    if len(line) > 0 {
+        lines = append(lines, line)
+    }
+    return lines
+}
+
+// pdfColor - цвет ARGB (RGB) в компоненты для PDF
+func pdfColor(color string) (uint8, uint8, uint8) {
+    if len(color) < 6 {
+        return 0, 0, 0
+    }
+    rgb, err := strconv.ParseUint(color[len(color)-6:], 16, 32)
+    if err != nil {
+        return 0, 0, 0
+    }
+    return uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb)
+}
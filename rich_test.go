@@ -0,0 +1,76 @@
+package xlsxt
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+)
+
+// openRichTemplate - шаблон, первая ячейка которого - форматированный текст: жирная метка и красное выражение
+func openRichTemplate(t *testing.T) *XlsxTemplateFile {
+    rows := [][]string{{"LABEL", `{{rich Note color="FF0000FF"}}`}, {"{{#each Items}}"}, {"{{rich Name}}"}, {"{{/each}}"}}
+    patch := func(name, data string) string {
+        if name == "xl/sharedStrings.xml" {
+            return strings.Replace(data, "<si><t>LABEL</t></si>",
+                `<si><r><rPr><b/><sz val="11"/><rFont val="Arial"/></rPr><t xml:space="preserve">Client: </t></r>`+
+                    `<r><rPr><sz val="11"/><color rgb="FFFF0000"/><rFont val="Arial"/></rPr><t>{{Client}}</t></r></si>`, 1)
+        }
+        return data
+    }
+    return openTestPackage(t, testSheetFile(rows), patch, nil)
+}
+
+var richData = map[string]interface{}{
+    "Client": "ACME",
+    "Note":   `**warn** plain *it* 5 \* 3`,
+    "Items":  []tableOrder{{Name: "a **b** c"}, {Name: "plain"}},
+}
+
+func TestRichText(t *testing.T) {
+    tpl := openRichTemplate(t)
+    if err := tpl.RenderTemplate(richData); err != nil {
+        t.Fatal(err)
+    }
+    // Значения ячеек - текст без разметки
+    checkValues(t, resultValues(tpl.result.Sheets[0]), [][]string{
+        {"Client: ACME", "warn plain it 5 * 3"},
+        {"a b c"},
+        {"plain"},
+    })
+    // Выражение получает шрифт фрагмента шаблона, разметка rich - поверх шрифта ячейки
+    checkContains(t, resultParts(t, tpl)["xl/worksheets/sheet1.xml"],
+        `<rPr><rFont val="Arial"/><b/><sz val="11"/></rPr><t xml:space="preserve">Client: </t>`,
+        `<color rgb="FFFF0000"/><sz val="11"/></rPr><t xml:space="preserve">ACME</t>`,
+        `<b/><color rgb="FF0000FF"/>`,
+        `<t xml:space="preserve">warn</t>`,
+        `<i/><color rgb="FF0000FF"/>`,
+        `<t xml:space="preserve"> 5 * 3</t>`,
+        `<b/><sz val="12"/></rPr><t xml:space="preserve">b</t>`,
+    )
+}
+
+func TestRichTextHTML(t *testing.T) {
+    tpl := openRichTemplate(t)
+    if err := tpl.RenderTemplate(richData); err != nil {
+        t.Fatal(err)
+    }
+    var buf bytes.Buffer
+    if err := tpl.WriteToHTML(&buf); err != nil {
+        t.Fatal(err)
+    }
+    checkContains(t, buf.String(), `<font face="Arial"><b>Client: </b></font>`, `color="#FF0000">ACME</font>`, `<b>warn</b>`, `<i>it</i>`)
+}
+
+func TestRichTextStream(t *testing.T) {
+    tpl := openRichTemplate(t)
+    var buf bytes.Buffer
+    if err := tpl.RenderStream(richData, &buf); err != nil {
+        t.Fatal(err)
+    }
+    // Потоковая запись - текст без разметки и меток фрагментов
+    sheet := readTestParts(t, buf.Bytes())["xl/worksheets/sheet1.xml"]
+    checkContains(t, sheet, "<t>Client: ACME</t>", "<t>warn plain it 5 * 3</t>", "<t>a b c</t>")
+    if strings.ContainsAny(sheet, richMarks) {
+        t.Errorf("sheet: %s", sheet)
+    }
+}
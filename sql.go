@@ -0,0 +1,131 @@
+package xlsxt
+
+import (
+    "time"
+    "reflect"
+    "strings"
+    "strconv"
+    "database/sql"
+)
+
+// sqlRow - строка результата запроса: значения колонок по их типам в БД
+// Ячейки из одного значения колонки ({{Amount}}) записываются числами и датами
+type sqlRow map[string]interface{}
+
+// isSQLRow - значение - строка результата запроса
+func isSQLRow(v reflect.Value) bool {
+    v = indirect(v)
+    return v.IsValid() && v.Type() == reflect.TypeOf(sqlRow(nil))
+}
+
+// sqlIterator - обход строк результата запроса: каждая строка - карта "имя колонки" -> значение
+// Строки читаются из курсора по одной, без сбора в память
+type sqlIterator struct {
+    rows    *sql.Rows
+    columns []string
+    types   []string
+    value   sqlRow
+    err     error
+}
+
+// newSQLIterator - итератор по строкам результата запроса
+func newSQLIterator(rows *sql.Rows) *sqlIterator {
+    it := &sqlIterator{rows: rows}
+    if it.columns, it.err = rows.Columns(); it.err != nil {
+        return it
+    }
+    it.types = make([]string, len(it.columns))
+    if columnTypes, err := rows.ColumnTypes(); err == nil {
+        for i, ct := range columnTypes {
+            if i < len(it.types) {
+                it.types[i] = strings.ToUpper(ct.DatabaseTypeName())
+            }
+        }
+    }
+    return it
+}
+
+// Next (sqlIterator)
+func (it *sqlIterator) Next() bool {
+    if it.err != nil || !it.rows.Next() {
+        return false
+    }
+    values := make([]interface{}, len(it.columns))
+    dest := make([]interface{}, len(it.columns))
+    for i := range values {
+        dest[i] = &values[i]
+    }
+    if it.err = it.rows.Scan(dest...); it.err != nil {
+        return false
+    }
+    it.value = make(sqlRow, len(it.columns))
+    for i, name := range it.columns {
+        it.value[name] = sqlValue(values[i], it.types[i])
+    }
+    return true
+}
+
+// Value (sqlIterator)
+func (it *sqlIterator) Value() interface{} {
+    return it.value
+}
+
+// Key (sqlIterator)
+func (it *sqlIterator) Key() interface{} {
+    return nil
+}
+
+// Close (sqlIterator) - закрытие курсора
+func (it *sqlIterator) Close() error {
+    return it.rows.Close()
+}
+
+// Err (sqlIterator) - ошибка чтения строк
+func (it *sqlIterator) Err() error {
+    if it.err != nil {
+        return it.err
+    }
+    return it.rows.Err()
+}
+
+// sqlValue - значение колонки с учетом ее типа в БД
+// Драйверы часто возвращают DECIMAL, NUMERIC и даты как текст - приводим их к числам и времени,
+// чтобы в ячейки попадали числа и даты, а не строки
+func sqlValue(value interface{}, dbType string) interface{} {
+    if b, ok := value.([]byte); ok {
+        value = string(b)
+    }
+    s, ok := value.(string)
+    if !ok {
+        return value
+    }
+    switch {
+    case strings.Contains(dbType, "INT"):
+        if n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil {
+            return n
+        }
+    case strings.Contains(dbType, "DEC") || strings.Contains(dbType, "NUMERIC") ||
+        strings.Contains(dbType, "FLOAT") || strings.Contains(dbType, "DOUBLE") ||
+        strings.Contains(dbType, "REAL") || strings.Contains(dbType, "MONEY"):
+        if n, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+            return n
+        }
+    case strings.Contains(dbType, "DATE") || strings.Contains(dbType, "TIME"):
+        for _, layout := range sqlTimeLayouts {
+            if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+                return t
+            }
+        }
+    }
+    return s
+}
+
+// sqlTimeLayouts - форматы дат и времени в текстовом представлении БД
+var sqlTimeLayouts = []string{
+    time.RFC3339Nano,
+    "2006-01-02 15:04:05.999999999-07:00",
+    "2006-01-02 15:04:05.999999999",
+    "2006-01-02T15:04:05.999999999",
+    "2006-01-02",
+    "15:04:05.999999999",
+}
@@ -0,0 +1,163 @@
+package xlsxt
+
+import (
+    "bytes"
+    "testing"
+    "database/sql"
+    "github.com/tealeg/xlsx"
+    _ "github.com/mattn/go-sqlite3"
+)
+
+// openTestDB - база SQLite в памяти с накладными
+func openTestDB(t *testing.T) *sql.DB {
+    db, err := sql.Open("sqlite3", ":memory:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, query := range []string{
+        `CREATE TABLE invoice (name TEXT, qty INTEGER, price DECIMAL(10,2), created DATE)`,
+        `INSERT INTO invoice VALUES ('a', 2, 1.5, '2024-01-02'), ('b', 3, 2.25, '2024-02-03')`,
+    } {
+        if _, err := db.Exec(query); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return db
+}
+
+// newTestTemplate - шаблон из значений ячеек строк одной вкладки
+func newTestTemplate(rows [][]string) *XlsxTemplateFile {
+    file := xlsx.NewFile()
+    sheet, _ := file.AddSheet("Sheet1")
+    for _, values := range rows {
+        row := sheet.AddRow()
+        for _, value := range values {
+            cell := row.AddCell()
+            cell.Value = value
+            cell.SetStyle(xlsx.NewStyle())
+        }
+    }
+    return &XlsxTemplateFile{template: file}
+}
+
+// invoiceTemplate - строки накладной из курсора
+var invoiceTemplate = [][]string{
+    {"{{#each Rows}}"},
+    {"{{name}}", "{{qty}}", "{{price}}", "{{created}}", "{{name}}: {{price}}"},
+    {"{{/each}}"},
+}
+
+// checkInvoiceRow - числа и даты записаны с типом, текст - строкой
+func checkInvoiceRow(t *testing.T, row *xlsx.Row, name, qty, price, created string) {
+    want := []struct {
+        value    string
+        numeric  bool
+    }{
+        {name, false},
+        {qty, true},
+        {price, true},
+        {created, true},
+        {name + ": " + price, false},
+    }
+    if len(row.Cells) < len(want) {
+        t.Fatalf("cells: %d", len(row.Cells))
+    }
+    for i, w := range want {
+        cell := row.Cells[i]
+        numeric := cell.Type() == xlsx.CellTypeNumeric
+        value, err := cell.FormattedValue()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if numeric != w.numeric || value != w.value {
+            t.Errorf("cell %d: %q (numeric %v), want %q (numeric %v)", i, value, numeric, w.value, w.numeric)
+        }
+    }
+}
+
+func TestSQLRowsTypedCells(t *testing.T) {
+    db := openTestDB(t)
+    defer db.Close()
+    rows, err := db.Query(`SELECT name, qty, price, created FROM invoice ORDER BY name`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tpl := newTestTemplate(invoiceTemplate)
+    if err := tpl.RenderTemplate(map[string]interface{}{"Rows": rows}); err != nil {
+        t.Fatal(err)
+    }
+    result := tpl.result.Sheets[0].Rows
+    if len(result) != 2 {
+        t.Fatalf("rows: %d", len(result))
+    }
+    checkInvoiceRow(t, result[0], "a", "2", "1.5", "01-02-24")
+    checkInvoiceRow(t, result[1], "b", "3", "2.25", "02-03-24")
+}
+
+func TestSQLRowsStream(t *testing.T) {
+    db := openTestDB(t)
+    defer db.Close()
+    rows, err := db.Query(`SELECT name, qty, price, created FROM invoice ORDER BY name`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var buf bytes.Buffer
+    tpl := newTestTemplate(invoiceTemplate)
+    if err := tpl.RenderStream(map[string]interface{}{"Rows": rows}, &buf); err != nil {
+        t.Fatal(err)
+    }
+    file, err := xlsx.OpenBinary(buf.Bytes())
+    if err != nil {
+        t.Fatal(err)
+    }
+    result := file.Sheets[0].Rows
+    if len(result) != 2 {
+        t.Fatalf("rows: %d", len(result))
+    }
+    checkInvoiceRow(t, result[0], "a", "2", "1.5", "01-02-24")
+    checkInvoiceRow(t, result[1], "b", "3", "2.25", "02-03-24")
+}
+
+func TestSQLTimeAndBigInt(t *testing.T) {
+    db := openTestDB(t)
+    defer db.Close()
+    if _, err := db.Exec(`CREATE TABLE shift (start TIME, code INTEGER)`); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := db.Exec(`INSERT INTO shift VALUES ('15:04:05', 1234567890123456789)`); err != nil {
+        t.Fatal(err)
+    }
+    rows, err := db.Query(`SELECT start, code FROM shift`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tpl := newTestTemplate([][]string{{"{{#each Rows}}"}, {"{{start}}", "{{code}}"}, {"{{/each}}"}})
+    if err := tpl.RenderTemplate(map[string]interface{}{"Rows": rows}); err != nil {
+        t.Fatal(err)
+    }
+    cells := tpl.result.Sheets[0].Rows[0].Cells
+    // Время без даты - доля суток с форматом времени
+    if cells[0].Type() != xlsx.CellTypeNumeric || cells[0].NumFmt != "h:mm:ss" {
+        t.Errorf("start: %q type %v format %q", cells[0].Value, cells[0].Type(), cells[0].NumFmt)
+    }
+    if value, _ := cells[0].FormattedValue(); value != "15:04:05" {
+        t.Errorf("start: %q", value)
+    }
+    // Целое больше 2^53 - текстом, без потери цифр
+    if cells[1].Type() == xlsx.CellTypeNumeric || cells[1].Value != "1234567890123456789" {
+        t.Errorf("code: %q type %v", cells[1].Value, cells[1].Type())
+    }
+}
+
+func TestPlainValuesStayText(t *testing.T) {
+    tpl := newTestTemplate([][]string{{"{{ID}}", "{{Amount}}"}})
+    if err := tpl.RenderTemplate(map[string]interface{}{"ID": int64(1234567890123456789), "Amount": 1.5}); err != nil {
+        t.Fatal(err)
+    }
+    for i, want := range []string{"1234567890123456789", "1.5"} {
+        cell := tpl.result.Sheets[0].Rows[0].Cells[i]
+        if cell.Type() == xlsx.CellTypeNumeric || cell.Value != want {
+            t.Errorf("cell %d: %q type %v", i, cell.Value, cell.Type())
+        }
+    }
+}
@@ -0,0 +1,487 @@
+package xlsxt
+
+import (
+    "io"
+    "context"
+    "fmt"
+    "errors"
+    "reflect"
+    "strings"
+    "database/sql"
+    "github.com/tealeg/xlsx"
+)
+
+// sizedIterator - итератор с известным количеством элементов (коллекция в памяти)
+type sizedIterator interface {
+    Len() int
+}
+
+// asIterator - реализует ли значение Iterator
+func asIterator(v reflect.Value) (Iterator, bool) {
+    if v.IsValid() && v.CanInterface() {
+        if it, ok := v.Interface().(Iterator); ok && !(v.Kind() == reflect.Ptr && v.IsNil()) {
+            return it, true
+        }
+    }
+    return nil, false
+}
+
+// streamIterator - итератор потокового источника:
+// функция обхода func(yield func(interface{}) bool) (в том числе iter.Seq и iter.Seq2 с ключами),
+// канал или *sql.Rows; nil - если значение не потоковый источник
+func streamIterator(v reflect.Value) Iterator {
+    if v.IsValid() && v.CanInterface() {
+        if rows, ok := v.Interface().(*sql.Rows); ok && rows != nil {
+            return newSQLIterator(rows)
+        }
+    }
+    v = indirect(v)
+    if !v.IsValid() {
+        return nil
+    }
+    t := v.Type()
+    switch v.Kind() {
+    case reflect.Chan:
+        if t.ChanDir()&reflect.RecvDir != 0 && !v.IsNil() {
+            return &chanIterator{ch: v}
+        }
+    case reflect.Func:
+        if v.IsNil() || t.NumIn() != 1 || t.NumOut() != 0 {
+            return nil
+        }
+        yield := t.In(0)
+        if yield.Kind() != reflect.Func || yield.NumIn() < 1 || yield.NumIn() > 2 ||
+            yield.NumOut() != 1 || yield.Out(0).Kind() != reflect.Bool {
+            return nil
+        }
+        return newSeqIterator(v)
+    }
+    return nil
+}
+
+// collectionType - может ли значение типа быть коллекцией: срезы, массивы, потоковые источники,
+// Iterator и DataSource (для интерфейсов - неизвестно до получения значения)
+func collectionType(t reflect.Type) bool {
+    if t.Kind() == reflect.Ptr && t.Elem().Kind() != reflect.Ptr {
+        t = t.Elem()
+    }
+    switch t.Kind() {
+    case reflect.Slice, reflect.Array, reflect.Chan, reflect.Func, reflect.Interface:
+        return true
+    }
+    ptr := reflect.PtrTo(t)
+    return t == reflect.TypeOf(sql.Rows{}) ||
+        ptr.Implements(reflect.TypeOf((*Iterator)(nil)).Elem()) ||
+        ptr.Implements(reflect.TypeOf((*DataSource)(nil)).Elem())
+}
+
+// streamSource - итератор потокового источника и признак однократного чтения:
+// каналы, *sql.Rows и значения Iterator читаются один раз, функции обхода - повторно
+func streamSource(v reflect.Value) (Iterator, bool) {
+    if it, ok := asIterator(v); ok {
+        return it, true
+    }
+    it := streamIterator(v)
+    if it == nil {
+        return nil, false
+    }
+    _, seq := it.(*seqIterator)
+    return it, !seq
+}
+
+// seqIterator - обход функции-итератора в отдельной горутине, элементы передаются по одному
+type seqIterator struct {
+    values chan [2]interface{}
+    stop   chan struct{}
+    value  [2]interface{}
+    err    error
+}
+
+// newSeqIterator - запуск функции-итератора
+func newSeqIterator(seq reflect.Value) *seqIterator {
+    it := &seqIterator{values: make(chan [2]interface{}), stop: make(chan struct{})}
+    yieldType := seq.Type().In(0)
+    yield := reflect.MakeFunc(yieldType, func(args []reflect.Value) []reflect.Value {
+        var entry [2]interface{}
+        // Для iter.Seq2 первый аргумент - ключ
+        entry[0] = args[len(args)-1].Interface()
+        if len(args) > 1 {
+            entry[1] = args[0].Interface()
+        }
+        select {
+        case it.values <- entry:
+            return []reflect.Value{reflect.ValueOf(true)}
+        case <-it.stop:
+            return []reflect.Value{reflect.ValueOf(false)}
+        }
+    })
+    go func() {
+        defer close(it.values)
+        defer func() {
+            if r := recover(); r != nil {
+                it.err = fmt.Errorf("Iterate: %v", r)
+            }
+        }()
+        seq.Call([]reflect.Value{yield})
+    }()
+    return it
+}
+
+// Next (seqIterator)
+func (it *seqIterator) Next() bool {
+    var ok bool
+    it.value, ok = <-it.values
+    return ok
+}
+
+// Value (seqIterator)
+func (it *seqIterator) Value() interface{} {
+    return it.value[0]
+}
+
+// Key (seqIterator)
+func (it *seqIterator) Key() interface{} {
+    return it.value[1]
+}
+
+// Close (seqIterator) - остановка обхода до его окончания
+func (it *seqIterator) Close() error {
+    select {
+    case <-it.stop:
+    default:
+        close(it.stop)
+    }
+    return nil
+}
+
+// Err (seqIterator) - ошибка (паника) функции-итератора
+func (it *seqIterator) Err() error {
+    return it.err
+}
+
+// chanIterator - чтение элементов из канала до его закрытия
+type chanIterator struct {
+    ch    reflect.Value
+    value interface{}
+}
+
+// Next (chanIterator)
+func (it *chanIterator) Next() bool {
+    v, ok := it.ch.Recv()
+    if ok {
+        it.value = v.Interface()
+    }
+    return ok
+}
+
+// Value (chanIterator)
+func (it *chanIterator) Value() interface{} {
+    return it.value
+}
+
+// Key (chanIterator)
+func (it *chanIterator) Key() interface{} {
+    return nil
+}
+
+// filterIterator - отбор элементов (where=) без сбора в память
+type filterIterator struct {
+    Iterator
+    where *filter
+}
+
+// Next (filterIterator)
+func (it *filterIterator) Next() bool {
+    for it.Iterator.Next() {
+        if it.where.match(reflect.ValueOf(it.Value())) {
+            return true
+        }
+    }
+    return false
+}
+
+// limitIterator - ограничение количества элементов (limit=)
+type limitIterator struct {
+    Iterator
+    limit int
+    count int
+}
+
+// Next (limitIterator)
+func (it *limitIterator) Next() bool {
+    if it.count >= it.limit || !it.Iterator.Next() {
+        return false
+    }
+    it.count++
+    return true
+}
+
+// closeIterator - освобождение итератора (остановка потокового источника)
+func closeIterator(it Iterator) {
+    for it != nil {
+        if c, ok := it.(io.Closer); ok {
+            c.Close()
+        }
+        switch w := it.(type) {
+        case *filterIterator:
+            it = w.Iterator
+        case *limitIterator:
+            it = w.Iterator
+        default:
+            return
+        }
+    }
+}
+
+// iteratorErr - ошибка потокового источника после обхода
+func iteratorErr(it Iterator) error {
+    for it != nil {
+        if e, ok := it.(interface{ Err() error }); ok {
+            if err := e.Err(); err != nil {
+                return err
+            }
+        }
+        switch w := it.(type) {
+        case *filterIterator:
+            it = w.Iterator
+        case *limitIterator:
+            it = w.Iterator
+        default:
+            return nil
+        }
+    }
+    return nil
+}
+
+// RenderStream (XlsxTemplateFile) - рендер шаблона с потоковой записью результата в writer
+// Строки записываются сразу после рендера и не накапливаются в памяти, поэтому циклы
+// по потоковым источникам (итераторы, каналы) обрабатывают отчеты любого размера.
+// Однократные источники (каналы, *sql.Rows) читаются только циклом: агрегаты и :length по ним - ошибка.
+// Ограничения потоковой записи: объединение ячеек, высота строк, ширина колонок, настройки вкладок
+// (печать, вид), форматирование фрагментов текста и структура строк не сохраняются,
+// результат не доступен для Save/SaveToPDF
+func (s *XlsxTemplateFile) RenderStream(v interface{}, writer io.Writer) error {
+    return s.RenderStreamContext(context.Background(), v, writer, RenderOptions{})
+}
+
+// RenderStreamContext (XlsxTemplateFile) - потоковый рендер с возможностью отмены и ограничениями
+// размера результата (превышение - ошибка *LimitError), MaxBytes - объем записанного в writer
+func (s *XlsxTemplateFile) RenderStreamContext(ctx context.Context, v interface{}, writer io.Writer, opts RenderOptions) (err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("Render template: %v", r)
+        }
+    }()
+    if s.template == nil {
+        return errors.New("Not load template xlsx file")
+    }
+    s.result, s.rows, s.rich = nil, nil, nil
+    guard := &renderGuard{ctx: ctx, opts: opts}
+    if err := guard.sheets(outputSheets(s.template)); err != nil {
+        return err
+    }
+    builder := xlsx.NewStreamFileBuilder(newLimitWriter(writer, opts.MaxBytes))
+    styles, err := addStreamStyles(builder, s.template)
+    if err != nil {
+        return err
+    }
+    // Строки из шаблонов {{#define}} могут быть шире строк вкладки
+    defined := 0
+    for _, sheet := range s.template.Sheets {
+        if isDefinesSheet(sheet) && sheetColumns(sheet) > defined {
+            defined = sheetColumns(sheet)
+        }
+    }
+    streams := make([]*rowStream, len(s.template.Sheets))
+    for i, sheet := range s.template.Sheets {
+        if isDefinesSheet(sheet) {
+            continue
+        }
+        streams[i] = &rowStream{styles: styles, columns: sheetColumns(sheet)}
+        if defined > streams[i].columns {
+            streams[i].columns = defined
+        }
+        columnStyles := make([]xlsx.StreamStyle, streams[i].columns)
+        for c := range columnStyles {
+            columnStyles[c] = xlsx.StreamStyleDefaultString
+        }
+        if err := builder.AddSheetS(sheet.Name, columnStyles); err != nil {
+            return err
+        }
+    }
+    file, err := builder.Build()
+    if err != nil {
+        return err
+    }
+    buffer := xlsx.NewFile()
+    for sheetIndex, sheet := range s.template.Sheets {
+        if streams[sheetIndex] == nil {
+            continue
+        }
+        if len(buffer.Sheets) > 0 {
+            if err := file.NextSheet(); err != nil {
+                return err
+            }
+        }
+        newSheet, err := buffer.AddSheet(sheet.Name)
+        if err != nil {
+            return err
+        }
+        streams[sheetIndex].file = file
+        if _, err := s.renderSheet(sheet, newSheet, getObject(v, sheetIndex), streams[sheetIndex], guard); err != nil {
+            return err
+        }
+    }
+    return file.Close()
+}
+
+// rowStream - потоковая запись строк вкладки
+type rowStream struct {
+    file    *xlsx.StreamFile
+    styles  map[streamStyleKey]xlsx.StreamStyle
+    columns int
+    rows    int
+}
+
+// streamStyleKey - стиль ячейки для потоковой записи
+type streamStyleKey struct {
+    style  xlsx.Style
+    numFmt int
+}
+
+// flush (rowStream) - запись готовых строк вкладки и удаление их из памяти
+func (st *rowStream) flush(sheet *xlsx.Sheet) error {
+    if st == nil {
+        return nil
+    }
+    for _, row := range sheet.Rows {
+        finishRow(row)
+        extractRich(row, nil)
+        cells := make([]xlsx.StreamCell, st.columns)
+        for i := range cells {
+            cells[i] = xlsx.NewStreamCell("", xlsx.StreamStyleDefaultString, xlsx.CellTypeString)
+            if i < len(row.Cells) && row.Cells[i] != nil {
+                cells[i] = st.cell(row.Cells[i])
+            }
+        }
+        if err := st.file.WriteS(cells); err != nil {
+            return err
+        }
+        st.rows++
+    }
+    sheet.Rows = sheet.Rows[:0]
+    sheet.MaxRow = 0
+    return nil
+}
+
+// written (rowStream) - количество записанных строк вкладки
+func (st *rowStream) written() int {
+    if st == nil {
+        return 0
+    }
+    return st.rows
+}
+
+// cell (rowStream) - ячейка потоковой записи со стилем шаблона
+func (st *rowStream) cell(cell *xlsx.Cell) xlsx.StreamCell {
+    style := xlsx.StreamStyleDefaultString
+    if cs := cell.GetStyle(); cs != nil {
+        if ss, ok := st.styles[styleKey(cs, cell.NumFmt)]; ok {
+            style = ss
+        }
+    }
+    cellType := xlsx.CellTypeString
+    switch cell.Type() {
+    case xlsx.CellTypeNumeric, xlsx.CellTypeDate:
+        if len(cell.Value) > 0 {
+            cellType = xlsx.CellTypeNumeric
+        }
+    case xlsx.CellTypeBool:
+        cellType = xlsx.CellTypeBool
+    }
+    return xlsx.NewStreamCell(cell.Value, style, cellType)
+}
+
+// addStreamStyles - регистрация стилей ячеек шаблона (и их жирных вариантов для [BR]),
+// для ячеек без формата - также с форматами дат (значения-даты записываются числами)
+func addStreamStyles(builder *xlsx.StreamFileBuilder, file *xlsx.File) (map[streamStyleKey]xlsx.StreamStyle, error) {
+    styles := make(map[streamStyleKey]xlsx.StreamStyle)
+    if err := builder.AddStreamStyle(xlsx.StreamStyleDefaultString); err != nil {
+        return nil, err
+    }
+    for _, sheet := range file.Sheets {
+        for _, row := range sheet.Rows {
+            for _, cell := range row.Cells {
+                style := cell.GetStyle()
+                if style == nil {
+                    continue
+                }
+                bold := *style
+                bold.Font.Bold = true
+                bold.ApplyFont = true
+                numFmts := []string{cell.NumFmt}
+                if builtinNumFmt[strings.ToLower(cell.NumFmt)] == 0 {
+                    numFmts = append(numFmts, xlsx.DefaultDateFormat, xlsx.DefaultDateTimeFormat, timeFormat)
+                }
+                for _, st := range []*xlsx.Style{style, &bold} {
+                    for _, numFmt := range numFmts {
+                        key := styleKey(st, numFmt)
+                        if _, ok := styles[key]; ok {
+                            continue
+                        }
+                        ss := xlsx.MakeStyle(key.numFmt, &key.style.Font, &key.style.Fill, &key.style.Alignment, &key.style.Border)
+                        if err := builder.AddStreamStyle(ss); err != nil {
+                            return nil, err
+                        }
+                        styles[key] = ss
+                    }
+                }
+            }
+        }
+    }
+    return styles, nil
+}
+
+// styleKey - ключ стиля ячейки
+func styleKey(style *xlsx.Style, numFmt string) streamStyleKey {
+    key := streamStyleKey{style: *style, numFmt: builtinNumFmt[strings.ToLower(numFmt)]}
+    key.style.NamedStyleIndex = nil
+    return key
+}
+
+// sheetColumns - количество колонок вкладки шаблона
+func sheetColumns(sheet *xlsx.Sheet) int {
+    columns := sheet.MaxCol
+    for _, row := range sheet.Rows {
+        if len(row.Cells) > columns {
+            columns = len(row.Cells)
+        }
+    }
+    if columns < 1 {
+        columns = 1
+    }
+    return columns
+}
+
+// builtinNumFmt - встроенные форматы чисел XLSX (потоковая запись поддерживает только их)
+var builtinNumFmt = map[string]int{
+    "general":         0,
+    "0":               1,
+    "0.00":            2,
+    "#,##0":           3,
+    "#,##0.00":        4,
+    "0%":              9,
+    "0.00%":           10,
+    "0.00e+00":        11,
+    "mm-dd-yy":        14,
+    "d-mmm-yy":        15,
+    "d-mmm":           16,
+    "mmm-yy":          17,
+    "h:mm am/pm":      18,
+    "h:mm:ss am/pm":   19,
+    "h:mm":            20,
+    "h:mm:ss":         21,
+    "m/d/yy h:mm":     22,
+    "mm:ss":           45,
+    "@":               49,
+}
@@ -0,0 +1,123 @@
+package xlsxt
+
+import (
+    "fmt"
+    "bytes"
+    "strings"
+    "testing"
+    "io/ioutil"
+    "github.com/tealeg/xlsx"
+)
+
+type streamRow struct {
+    Name   string
+    Amount float64
+}
+
+type streamDoc struct {
+    Title string
+    Rows  func(yield func(interface{}) bool)
+    Ch    chan streamRow
+    Pairs func(func(string, int) bool)
+}
+
+// newStreamDoc - данные с функциями обхода (n строк) и каналом
+func newStreamDoc(n int) *streamDoc {
+    ch := make(chan streamRow, 2)
+    ch <- streamRow{"c1", 1}
+    ch <- streamRow{"c2", 2}
+    close(ch)
+    return &streamDoc{
+        Title: "T",
+        Ch:    ch,
+        Rows: func(yield func(interface{}) bool) {
+            for i := 0; i < n; i++ {
+                if !yield(streamRow{fmt.Sprint("r", i), float64(i)}) {
+                    return
+                }
+            }
+        },
+        Pairs: func(yield func(string, int) bool) {
+            _ = yield("a", 1) && yield("b", 2)
+        },
+    }
+}
+
+var streamRows = [][]string{
+    {"{{Title}}"},
+    {`{{#each Rows where="Amount > 0" limit=3}}`},
+    {"{{@number}} {{@last}}", "{{Name}}", "{{Amount}}", "{{@row}}"},
+    {"{{/each}}"},
+    {"{{#each Ch}}"},
+    {"{{Name}}", "{{@last}}"},
+    {"{{/each}}"},
+    {"{{#each Pairs}}"},
+    {"{{@key}}={{this}}"},
+    {"{{/each}}"},
+    {"{{#each Rows sort=-Amount limit=2}}"},
+    {"{{Name}}"},
+    {"{{/each}}"},
+    {"{{sum Rows.Amount}}"},
+}
+
+func TestSeqAndChannelBlocks(t *testing.T) {
+    // Функции обхода читаются повторно (для агрегата), канал - один раз
+    checkValues(t, renderTestValues(t, streamRows, newStreamDoc(5)), [][]string{
+        {"T"},
+        {"1 false", "r1", "1", "2"},
+        {"2 false", "r2", "2", "3"},
+        {"3 true", "r3", "3", "4"},
+        {"c1", "false"},
+        {"c2", "true"},
+        {"a=1"},
+        {"b=2"},
+        {"r4"},
+        {"r3"},
+        {"10"},
+    })
+}
+
+func TestRenderStream(t *testing.T) {
+    tpl := newTestTemplate(streamRows)
+    var buf bytes.Buffer
+    if err := tpl.RenderStream(newStreamDoc(5), &buf); err != nil {
+        t.Fatal(err)
+    }
+    file, err := xlsx.OpenBinary(buf.Bytes())
+    if err != nil {
+        t.Fatal(err)
+    }
+    var names []string
+    for _, row := range file.Sheets[0].Rows {
+        names = append(names, row.Cells[0].Value)
+    }
+    want := []string{"T", "1 false", "2 false", "3 true", "c1", "c2", "a=1", "b=2", "r4", "r3", "10"}
+    if fmt.Sprintf("%q", names) != fmt.Sprintf("%q", want) {
+        t.Errorf("rows: %q", names)
+    }
+    // Большая последовательность не накапливается в памяти
+    if err := tpl.RenderStream(newStreamDoc(100000), ioutil.Discard); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestOneShotSourceReadTwice(t *testing.T) {
+    lines := func() interface{} {
+        ch := make(chan streamRow, 2)
+        ch <- streamRow{"a", 1}
+        ch <- streamRow{"b", 2}
+        close(ch)
+        return struct{ Lines chan streamRow }{ch}
+    }
+    rows := [][]string{{"{{#each Lines}}"}, {"{{Amount}}"}, {"{{/each}}"}, {"total", "{{sum Lines.Amount}}"}}
+    // Канал нельзя прочитать для цикла и еще раз для агрегата
+    if err := newTestTemplate(rows).RenderTemplate(lines()); err == nil || !strings.Contains(err.Error(), "One-shot") {
+        t.Errorf("render: %v", err)
+    }
+    if err := newTestTemplate(rows).RenderStream(lines(), ioutil.Discard); err == nil || !strings.Contains(err.Error(), "One-shot") {
+        t.Errorf("stream: %v", err)
+    }
+    if err := newTestTemplate([][]string{{"{{Lines:length}}"}}).RenderTemplate(lines()); err == nil {
+        t.Error("length: no error")
+    }
+}
@@ -0,0 +1,154 @@
+package xlsxt
+
+import (
+    "reflect"
+    "strconv"
+    "strings"
+    "database/sql"
+    "encoding/xml"
+    "github.com/tealeg/xlsx"
+)
+
+// tableInfo - таблица Excel (ListObject) вкладки шаблона
+// Строки данных таблицы повторяются для каждого элемента коллекции с именем таблицы
+type tableInfo struct {
+    path     string // часть пакета (xl/tables/table1.xml)
+    name     string // имя таблицы (displayName)
+    from, to int    // строки данных таблицы (с единицы)
+}
+
+// readTable - таблица из XML части пакета (nil - не удалось разобрать)
+func readTable(path, data string) *tableInfo {
+    var table struct {
+        Name           string `xml:"name,attr"`
+        DisplayName    string `xml:"displayName,attr"`
+        Ref            string `xml:"ref,attr"`
+        HeaderRowCount *int   `xml:"headerRowCount,attr"`
+        TotalsRowCount int    `xml:"totalsRowCount,attr"`
+    }
+    if err := xml.Unmarshal([]byte(data), &table); err != nil {
+        return nil
+    }
+    sides := strings.SplitN(table.Ref, ":", 2)
+    if len(sides) < 2 {
+        return nil
+    }
+    from, to := rxCellRef.FindStringSubmatch(sides[0]), rxCellRef.FindStringSubmatch(sides[1])
+    if from == nil || to == nil {
+        return nil
+    }
+    t := &tableInfo{path: path, name: table.DisplayName}
+    if len(t.name) < 1 {
+        t.name = table.Name
+    }
+    header := 1
+    if table.HeaderRowCount != nil {
+        header = *table.HeaderRowCount
+    }
+    t.from, _ = strconv.Atoi(from[3])
+    t.to, _ = strconv.Atoi(to[3])
+    t.from += header
+    t.to -= table.TotalsRowCount
+    return t
+}
+
+// mapXML (tableInfo) - диапазоны таблицы (ref таблицы, автофильтра, сортировки) по строкам результата
+// Таблица без строк данных сохраняет одну пустую строку (Excel не допускает таблиц без строк)
+func (t *tableInfo) mapXML(data string, m *rowMap) string {
+    _, _, hasRows := m.span(t.from, t.to)
+    return rxRefAttr.ReplaceAllStringFunc(data, func(attr string) string {
+        mapped, ok := m.mapRange(rxRefAttr.FindStringSubmatch(attr)[1])
+        if !ok {
+            return attr
+        }
+        if !hasRows && t.from <= t.to {
+            if sides := strings.SplitN(mapped, ":", 2); len(sides) > 1 {
+                if end := rxCellRef.FindStringSubmatch(sides[1]); end != nil {
+                    row, _ := strconv.Atoi(end[3])
+                    mapped = sides[0] + ":" + end[1] + end[2] + strconv.Itoa(row+1)
+                }
+            }
+        }
+        return ` ref="` + mapped + `"`
+    })
+}
+
+// bindTables - строки данных таблиц, для которых в данных есть коллекция с именем таблицы,
+// становятся циклом {{#each <Имя таблицы>}} (если строки еще не в блоке).
+// Для пустой коллекции выводится одна пустая строка данных (Excel не допускает таблиц без строк),
+// m - строки результата (пустая строка считается строкой данных таблицы)
+func bindTables(blocks []*block, rows []*xlsx.Row, tables []*tableInfo, obj interface{}, less func(a, b interface{}) bool, m *rowMap) []*block {
+    source := sourceOf(reflect.ValueOf(obj), less)
+    for _, table := range tables {
+        if table.from < 1 || table.to > len(rows) || table.from > table.to {
+            continue
+        }
+        if v, ok := source.Get(table.name); !ok || !isCollection(v) {
+            continue
+        }
+        // Строки данных - подряд идущие строки верхнего уровня
+        start := -1
+        for i, b := range blocks {
+            if b.row == rows[table.from-1] {
+                start = i
+                break
+            }
+        }
+        count := table.to - table.from + 1
+        if start < 0 || start+count > len(blocks) {
+            continue
+        }
+        bound := true
+        for i := 0; i < count; i++ {
+            if blocks[start+i].row != rows[table.from-1+i] {
+                bound = false
+                break
+            }
+        }
+        if !bound {
+            continue
+        }
+        each := &block{kind: "each", path: strings.Split(table.name, "."), args: map[string]string{}}
+        each.parseArgs()
+        each.children = append(each.children, blocks[start:start+count]...)
+        blank := blankRow(rows[table.from-1])
+        m.alias(blank, rows[table.from-1])
+        each.empty = []*block{{row: blank}}
+        blocks = append(blocks[:start], append([]*block{each}, blocks[start+count:]...)...)
+    }
+    return blocks
+}
+
+// blankRow - копия строки шаблона с пустыми ячейками (стили и высота сохраняются)
+func blankRow(row *xlsx.Row) *xlsx.Row {
+    blank := &xlsx.Row{Sheet: row.Sheet, Height: row.Height}
+    for _, cell := range row.Cells {
+        c := *cell
+        c.Value = ""
+        c.Row = blank
+        blank.Cells = append(blank.Cells, &c)
+    }
+    return blank
+}
+
+// isCollection - можно ли обойти значение циклом
+func isCollection(value interface{}) bool {
+    if _, ok := value.(*sql.Rows); ok {
+        return true
+    }
+    v := reflect.ValueOf(value)
+    if _, ok := asDataSource(v); ok {
+        return true
+    }
+    if _, ok := asIterator(v); ok {
+        return true
+    }
+    v = indirect(v)
+    switch v.Kind() {
+    case reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+        return true
+    case reflect.Func:
+        return v.Type().NumIn() == 1 && v.Type().NumOut() == 0
+    }
+    return false
+}
@@ -0,0 +1,77 @@
+package xlsxt
+
+import (
+    "regexp"
+    "testing"
+    "github.com/tealeg/xlsx"
+)
+
+// tableOrder - строка таблицы Orders
+type tableOrder struct {
+    Name string
+    Qty  int
+}
+
+// openTableTemplate - шаблон с таблицей Orders (A1:B2: заголовок и строка данных) и строкой итога
+func openTableTemplate(t *testing.T) *XlsxTemplateFile {
+    file := xlsx.NewFile()
+    sheet, _ := file.AddSheet("S1")
+    for _, values := range [][]string{{"Name", "Qty"}, {"{{Name}}", "{{Qty}}"}, {"Total", "{{sum Orders.Qty}}"}} {
+        row := sheet.AddRow()
+        for _, value := range values {
+            row.AddCell().Value = value
+        }
+    }
+    table := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+        `<table xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" id="1" name="Orders" displayName="Orders" ref="A1:B2" totalsRowShown="0">` +
+        `<autoFilter ref="A1:B2"/><tableColumns count="2"><tableColumn id="1" name="Name"/><tableColumn id="2" name="Qty"/></tableColumns></table>`
+    patch := func(name, data string) string {
+        switch name {
+        case "xl/worksheets/sheet1.xml":
+            return addSheetElement(data, "tableParts", `<tableParts count="1"><tablePart r:id="rId1"/></tableParts>`)
+        case "[Content_Types].xml":
+            return addContentTypes(data, map[string]string{
+                "xl/tables/table1.xml": "application/vnd.openxmlformats-officedocument.spreadsheetml.table+xml",
+            })
+        }
+        return data
+    }
+    return openTestPackage(t, file, patch, map[string]string{
+        "xl/tables/table1.xml":                table,
+        "xl/worksheets/_rels/sheet1.xml.rels": sheetRels([3]string{"rId1", "table", "../tables/table1.xml"}),
+    })
+}
+
+var rxTableRef = regexp.MustCompile(`<table [^>]*\sref="([^"]*)"`)
+
+func TestTableGrowsWithRows(t *testing.T) {
+    tpl := openTableTemplate(t)
+    data := struct{ Orders []tableOrder }{[]tableOrder{{"a", 1}, {"b", 2}, {"c", 3}}}
+    if err := tpl.RenderTemplate(data); err != nil {
+        t.Fatal(err)
+    }
+    values := resultValues(tpl.result.Sheets[0])
+    if len(values) != 5 || values[3][0] != "c" || values[4][0] != "Total" || values[4][1] != "6" {
+        t.Fatalf("rows: %q", values)
+    }
+    table := resultParts(t, tpl)["xl/tables/table1.xml"]
+    if ref := rxTableRef.FindStringSubmatch(table); ref == nil || ref[1] != "A1:B4" {
+        t.Errorf("table: %s", table)
+    }
+}
+
+func TestEmptyTableKeepsBlankRow(t *testing.T) {
+    tpl := openTableTemplate(t)
+    if err := tpl.RenderTemplate(struct{ Orders []tableOrder }{}); err != nil {
+        t.Fatal(err)
+    }
+    // Таблица - заголовок и одна пустая строка, строка итога ниже таблицы
+    values := resultValues(tpl.result.Sheets[0])
+    if len(values) != 3 || values[1][0] != "" || values[1][1] != "" || values[2][0] != "Total" {
+        t.Fatalf("rows: %q", values)
+    }
+    table := resultParts(t, tpl)["xl/tables/table1.xml"]
+    if ref := rxTableRef.FindStringSubmatch(table); ref == nil || ref[1] != "A1:B2" {
+        t.Errorf("table: %s", table)
+    }
+}
@@ -3,7 +3,12 @@ package xlsxt
 import (
     "io"    
     "fmt"
+    "math"
+    "time"
+    "context"
+    "sort"
     "errors"
+    "encoding"
     "regexp"
     "reflect"    
     "strings"   
@@ -15,18 +20,44 @@ import (
 )
 
 var (
-    rxTemplateItem  = regexp.MustCompile(`\{\{\s*([\w|\.]+)\s*\}\}`)
-	rxMergeCellV    = regexp.MustCompile(`\[\s?v-merge\s?\]`)
+	rxMergeCellV    = regexp.MustCompile(`\[\s?v-merge\s?(?::\s?([A-Za-z]+)\s?)?\]`)
+    rxMergeParent   = regexp.MustCompile(`\[\s?v-merge\s?:\s?parent\s?\]`)
+    rxMergeCellH    = regexp.MustCompile(`\[\s?h-merge\s?\]`)
     rxMergeIndex    = regexp.MustCompile(`\[\s?index\s?:\s?[\d|\.|\,]+\s?\]`)
     rxBrCellV       = regexp.MustCompile(`\[\s?BR\s?\]`)
+    rxAutoWidth     = regexp.MustCompile(`\[\s?auto-width\s?\]`)
+    rxTemplateExpr  = regexp.MustCompile(`\{\{\{?(.*?)\}?\}\}`)
+    rxFieldPath     = regexp.MustCompile(`^[\w\.]+$`)
+    rxHashArg       = regexp.MustCompile(`(\w+)\s*=\s*("[^"]*"|'[^']*'|[^\s\}]+)`)
+    rxExprToken     = regexp.MustCompile(`"[^"]*"|'[^']*'|[^\s"']+`)
+    rxExprHashArg   = regexp.MustCompile(`^(\w+)=(.+)$`)
+    rxExprPath      = regexp.MustCompile(`^(?:\.\./)*@?[\w\.]+(?::length)?$`)
 )
 
+func init() {
+    // {{default Field "—"}} - значение по умолчанию для пустых полей
+    raymond.RegisterHelper("default", func(value interface{}, fallback interface{}) interface{} {
+        if isEmpty(reflect.ValueOf(value)) {
+            return fallback
+        }
+        return value
+    })
+}
+
 
 // XlsxTemplateFile - файл шаблонизатора
 type XlsxTemplateFile struct {
     template *xlsx.File
     result *xlsx.File
     fontDir string
+    keyOrder func(a, b interface{}) bool
+    workers int
+    parts *templateParts
+    rows []*rowMap
+    rich richText
+    autoFit bool
+    outline Outline
+    maxBytes int64
 }
 
 // SetFontDir (XlsxTemplateFile)
@@ -34,23 +65,27 @@ func (s *XlsxTemplateFile) SetFontDir(path string) {
     s.fontDir = path
 }
 
+// SetMapKeyOrder (XlsxTemplateFile) - порядок обхода ключей карт в данных
+// (по умолчанию ключи сортируются по возрастанию)
+func (s *XlsxTemplateFile) SetMapKeyOrder(less func(a, b interface{}) bool) {
+    s.keyOrder = less
+}
+
 // Save (XlsxTemplateFile) - сохраняем результат
 func (s *XlsxTemplateFile) Save(path string) error {
-	if s.result != nil {
-        return s.result.Save(path)		
-    } else if s.template != nil {
-        return s.template.Save(path)
+    if s.result == nil && s.template == nil {
+        return errors.New("Not load template xlsx file")
     }
-    return errors.New("Not load template xlsx file")
+    return saveFile(path, s.Write)
 }
 
 // SaveToHTML (XlsxTemplateFile) - сохраняем результат в PDF
 func (s *XlsxTemplateFile) SaveToHTML(path string) error {
     var html string
 	if s.result != nil {
-        html = convertXlsxToHTML(s.result, true)
+        html = convertXlsxToHTML(s.result, s.rich, true)
     } else if s.template != nil {
-        html = convertXlsxToHTML(s.template, true)
+        html = convertXlsxToHTML(s.template, nil, true)
     }
     if len(html) > 0 {        
         err := ioutil.WriteFile(path, []byte(html), 0655)
@@ -66,9 +101,9 @@ func (s *XlsxTemplateFile) SaveToHTML(path string) error {
 func (s *XlsxTemplateFile) WriteToHTML(writer io.Writer) error {
     var html string
 	if s.result != nil {
-        html = convertXlsxToHTML(s.result, true)
+        html = convertXlsxToHTML(s.result, s.rich, true)
     } else if s.template != nil {
-        html = convertXlsxToHTML(s.template, true)
+        html = convertXlsxToHTML(s.template, nil, true)
     }
     if len(html) > 0 {        
         _, err := writer.Write([]byte(html))
@@ -82,11 +117,17 @@ func (s *XlsxTemplateFile) WriteToHTML(writer io.Writer) error {
 
 // SaveToPDF (XlsxTemplateFile) - сохраняем результат в PDF
 func (s *XlsxTemplateFile) SaveToPDF(path string) error {
-    var pdf *gopdf.GoPdf
+    var (
+        pdf *gopdf.GoPdf
+        err error
+    )
 	if s.result != nil {
-        pdf = convertXlsxToPdf(s.result, s.fontDir)
+        pdf, err = convertXlsxToPdf(context.Background(), s.result, s.rich, s.fontDir)
     } else if s.template != nil {
-        pdf = convertXlsxToPdf(s.template, s.fontDir)
+        pdf, err = convertXlsxToPdf(context.Background(), s.template, nil, s.fontDir)
+    }
+    if err != nil {
+        return err
     }
     if pdf != nil {        
         pdf.WritePdf(path)
@@ -97,11 +138,22 @@ func (s *XlsxTemplateFile) SaveToPDF(path string) error {
 
 // WriteToPDF (XlsxTemplateFile) - пишем результат в io.Writer
 func (s *XlsxTemplateFile) WriteToPDF(writer io.Writer) error {
-    var pdf *gopdf.GoPdf
+    return s.WriteToPDFContext(context.Background(), writer)
+}
+
+// WriteToPDFContext (XlsxTemplateFile) - пишем результат в io.Writer с возможностью отмены
+func (s *XlsxTemplateFile) WriteToPDFContext(ctx context.Context, writer io.Writer) error {
+    var (
+        pdf *gopdf.GoPdf
+        err error
+    )
 	if s.result != nil {
-        pdf = convertXlsxToPdf(s.result, s.fontDir)
+        pdf, err = convertXlsxToPdf(ctx, s.result, s.rich, s.fontDir)
     } else if s.template != nil {
-        pdf = convertXlsxToPdf(s.template, s.fontDir)
+        pdf, err = convertXlsxToPdf(ctx, s.template, nil, s.fontDir)
+    }
+    if err != nil {
+        return err
     }
     if pdf != nil {
         bytes, err := pdf.GetBytesPdfReturnErr()
@@ -124,7 +176,7 @@ func removeMergeCells(file *xlsx.File) {
             for rowIndex, row := range sheet.Rows {
                 for cellIndex, cell := range row.Cells {
                     if cell.HMerge > 0 {
-                        for x := 1; x <= cell.HMerge; x++ {
+                        for x := 1; x <= cell.HMerge && cellIndex+x < len(row.Cells); x++ {
                             c := row.Cells[cellIndex+x]
                             if c != nil {
                                 c.Value = ""
@@ -133,9 +185,9 @@ func removeMergeCells(file *xlsx.File) {
                         }
                     }
                     if cell.VMerge > 0 {
-                        for y := 1; y <= cell.VMerge; y++ {
+                        for y := 1; y <= cell.VMerge && rowIndex+y < len(sheet.Rows); y++ {
                             r := sheet.Rows[rowIndex+y]
-                            if r != nil {
+                            if r != nil && cellIndex < len(r.Cells) {
                                 c := r.Cells[cellIndex]
                                 if c != nil {
                                     c.Value = ""
@@ -150,9 +202,48 @@ func removeMergeCells(file *xlsx.File) {
     }
 }
 
+// copyFile - копия файла для конвертации (PDF, HTML правят ячейки и стили)
+// wrapText - перенос текста во всех ячейках со стилем (для PDF).
+// Возвращает и фрагменты форматированного текста ячеек копии
+func copyFile(file *xlsx.File, rich richText, wrapText bool) (*xlsx.File, richText) {
+    if file == nil {
+        return nil, nil
+    }
+    result, resultRich := xlsx.NewFile(), make(richText)
+    for _, sheet := range file.Sheets {
+        newSheet, err := result.AddSheet(sheet.Name)
+        if err != nil {
+            newSheet = &xlsx.Sheet{Name: sheet.Name, File: result}
+            result.Sheets = append(result.Sheets, newSheet)
+        }
+        cloneSheet(sheet, newSheet)
+        for _, row := range sheet.Rows {
+            newRow := newSheet.AddRow()
+            cloneRow(row, newRow)
+            for i, cell := range newRow.Cells {
+                var runs []textRun
+                if cell.Value, runs = cellRichText(row.Cells[i], rich); runs != nil {
+                    resultRich[cell] = runs
+                } else {
+                    cell.Value = cellText(row.Cells[i])
+                }
+                if style := cell.GetStyle(); style != nil {
+                    copyStyle := *style
+                    if wrapText {
+                        copyStyle.Alignment.WrapText = true
+                    }
+                    cell.SetStyle(&copyStyle)
+                }
+            }
+        }
+    }
+    return result, resultRich
+}
+
 // convertXlsxToHTML - в HTML
-func convertXlsxToHTML(file *xlsx.File, landscape bool) string {
+func convertXlsxToHTML(file *xlsx.File, rich richText, landscape bool) string {
     html := ""
+    file, rich = copyFile(file, rich, false)
     removeMergeCells(file)
     if file != nil {
         html += "<!DOCTYPE HTML PUBLIC \"-//W3C//DTD HTML 4.0 Transitional//EN\">\n"
@@ -241,7 +332,9 @@ func convertXlsxToHTML(file *xlsx.File, landscape bool) string {
                             }
                         }
                         html +=">"
-                        if style != nil {
+                        if runs := rich[cell]; runs != nil {
+                            html += htmlRuns(runs)
+                        } else if style != nil {
                             if style.ApplyFont {
                                 html += "<font"
                                 if len(style.Font.Name) > 0 {
@@ -287,19 +380,40 @@ func convertXlsxToHTML(file *xlsx.File, landscape bool) string {
     return html
 }
 
-// convertXlsxToPdf - конвертирование XLSX в PDF
-func convertXlsxToPdf(file *xlsx.File, fontDir string) *gopdf.GoPdf {
+// convertXlsxToPdf - конвертирование XLSX в PDF (nil без файла)
+// Ошибка загрузки шрифтов из fontDir или отмена ctx возвращается как ошибка
+func convertXlsxToPdf(ctx context.Context, file *xlsx.File, rich richText, fontDir string) (*gopdf.GoPdf, error) {
+    // Правки для PDF (перенос текста, объединения) - только в копии файла
+    file, rich = copyFile(file, rich, true)
     removeMergeCells(file)
     if file != nil {
         pdf := gopdf.GoPdf{}
         w, h := 841.89, 595.28        
         pdf.Start(gopdf.Config{Unit: "pt", PageSize: gopdf.Rect{W: w, H: h}})        
         var addFonts = make(map[string]bool)
+        // Ширина и высота строки текста фрагмента его шрифтом
+        measure := func(style *xlsx.Style, font xlsx.Font, text string) (float64, float64) {
+            runStyle := runStyle(style, font)
+            if err := pdf.SetFont(toPdfFont(runStyle), getPdfFontStyleFromXLSXStyle(runStyle), font.Size); err != nil {
+                return 0.0, float64(font.Size)
+            }
+            w, _ := pdf.MeasureTextWidth(text)
+            _, h, err := pdf.MeasureText("Z")
+            if err != nil {
+                h = float64(font.Size)
+            }
+            return w, h
+        }
+        // Строки фрагментов форматированного текста ячеек
+        richLines := make(map[*xlsx.Cell][][]textRun)
         for _, sheet := range file.Sheets {
             pdf.AddPage()
             pdf.SetX(0);pdf.SetY(0)            
             x, y, kW := 0.0, 0.0, w/getSheetWidth(sheet)
             for _, row := range sheet.Rows {
+                if err := ctx.Err(); err != nil {
+                    return nil, err
+                }
                 // Анализ и правка высоты ячейки
                 // Выставление шрифтов
                 for i, cell := range row.Cells {                    
@@ -310,18 +424,45 @@ func convertXlsxToPdf(file *xlsx.File, fontDir string) *gopdf.GoPdf {
                             if !addFonts[fontName] {
                                 err := pdf.AddTTFFont(fontName, fontDir+"/"+fontName+".ttf")
                                 if err != nil {
-                                    fmt.Println("Error load font: ", fontDir+"/"+fontName + ".ttf ", err)
-                                    return nil
+                                    return nil, fmt.Errorf("Error load font: %s: %v", fontDir+"/"+fontName+".ttf", err)
                                 }
                                 addFonts[fontName] = true
                             }
                             err := pdf.SetFont(fontName, getPdfFontStyleFromXLSXStyle(style), style.Font.Size)
-                            if err != nil {                                
-                                fmt.Println("Error set font: ", fontDir+"/"+fontName + ".ttf ", err)
-                                return nil
+                            if err != nil {
+                                return nil, fmt.Errorf("Error set font: %s: %v", fontDir+"/"+fontName+".ttf", err)
                             }
-                            // Только для WrapText
-                            if style.Alignment.WrapText {                       
+                            // Фрагменты форматированного текста - своими шрифтами, перенос по словам
+                            if runs := rich[cell]; runs != nil {
+                                for _, run := range runs {
+                                    runFont := toPdfFont(runStyle(style, run.Font))
+                                    if !addFonts[runFont] {
+                                        if err := pdf.AddTTFFont(runFont, fontDir+"/"+runFont+".ttf"); err != nil {
+                                            return nil, fmt.Errorf("Error load font: %s: %v", fontDir+"/"+runFont+".ttf", err)
+                                        }
+                                        addFonts[runFont] = true
+                                    }
+                                }
+                                lines := [][]textRun{runs}
+                                if style.Alignment.WrapText {
+                                    mergeWidth, mergeHeight := getMergeSizesFromCell(cell)
+                                    lines = wrapRuns(runs, (sheet.Cols[i].Width+mergeWidth)*kW, func(font xlsx.Font, text string) float64 {
+                                        w, _ := measure(style, font, text)
+                                        return w
+                                    })
+                                    if len(lines) > 1 {
+                                        style.Alignment.Vertical = "top"
+                                        height := 0.0
+                                        for _, line := range lines {
+                                            height += richLineHeight(line, style, measure)
+                                        }
+                                        if height > row.Height+mergeHeight {
+                                            row.Height = height-mergeHeight
+                                        }
+                                    }
+                                }
+                                richLines[cell] = lines
+                            } else if style.Alignment.WrapText {                       
                                 mergeWidth, mergeHeight := getMergeSizesFromCell(cell)
                                 cellWidth := (sheet.Cols[i].Width+mergeWidth)*kW
                                 if textWidth, err := pdf.MeasureTextWidth(cell.Value); err == nil {                            
@@ -386,11 +527,15 @@ func convertXlsxToPdf(file *xlsx.File, fontDir string) *gopdf.GoPdf {
                             fontName := toPdfFont(style)                            
                             err := pdf.SetFont(fontName, getPdfFontStyleFromXLSXStyle(style), style.Font.Size)
                             if err != nil {
-                                fmt.Println("Error set(2) font: ", fontDir+"/"+fontName + ".ttf ", err)
-                                return nil
+                                return nil, fmt.Errorf("Error set font: %s: %v", fontDir+"/"+fontName+".ttf", err)
                             }
                         }
                         mergeWidth, mergeHeight := getMergeSizesFromCell(cell)
+                        if lines, ok := richLines[cell]; ok {
+                            drawRichLines(&pdf, lines, style, x, &gopdf.Rect{W: cellWidth+mergeWidth*kW, H: cellHeigth+mergeHeight}, measure)
+                            x += cellWidth; pdf.SetX(x); pdf.SetY(y)
+                            continue
+                        }
                         lines := strings.Split(cell.Value, "\n")
                         for lineIndex, line := range lines {
                             line = strings.Replace(line, "₽", "р.",-1)
@@ -420,9 +565,56 @@ func convertXlsxToPdf(file *xlsx.File, fontDir string) *gopdf.GoPdf {
                 pdf.SetX(x);pdf.SetY(y)
             }
         }
-        return &pdf
+        return &pdf, nil
+    }
+    return nil, nil
+}
+
+// richLineHeight - высота строки фрагментов (по самому высокому шрифту)
+func richLineHeight(line []textRun, style *xlsx.Style, measure func(*xlsx.Style, xlsx.Font, string) (float64, float64)) float64 {
+    height := 0.0
+    for _, run := range line {
+        if _, h := measure(style, run.Font, run.Text); h > height {
+            height = h
+        }
+    }
+    return height
+}
+
+// drawRichLines - вывод строк фрагментов форматированного текста ячейки rect с левого края x
+// Рамка ячейки выводится по первой строке, выравнивание по горизонтали - по ширине всей строки фрагментов
+func drawRichLines(pdf *gopdf.GoPdf, lines [][]textRun, style *xlsx.Style, x float64, rect *gopdf.Rect, measure func(*xlsx.Style, xlsx.Font, string) (float64, float64)) {
+    pdf.CellWithOption(rect, "", toPdfCellOption(style, false))
+    opt := toPdfCellOption(style, true)
+    opt.Align = opt.Align &^ (gopdf.Center | gopdf.Right) | gopdf.Left
+    for lineIndex, line := range lines {
+        h := rect.H
+        if lineIndex > 0 {
+            h = richLineHeight(line, style, measure)
+            pdf.Br(h)
+        }
+        lineY := pdf.GetY()
+        total := 0.0
+        for _, run := range line {
+            w, _ := measure(style, run.Font, run.Text)
+            total += w
+        }
+        runX := x
+        if style != nil && style.Alignment.Horizontal == "center" {
+            runX += (rect.W-total)/2
+        } else if style != nil && style.Alignment.Horizontal == "right" {
+            runX += rect.W-total
+        }
+        for _, run := range line {
+            // measure выставляет шрифт фрагмента
+            w, _ := measure(style, run.Font, run.Text)
+            pdf.SetTextColor(pdfColor(run.Font.Color))
+            pdf.SetX(runX); pdf.SetY(lineY)
+            pdf.CellWithOption(&gopdf.Rect{W: w, H: h}, strings.Replace(run.Text, "₽", "р.", -1), opt)
+            runX += w
+        }
+        pdf.SetTextColor(0, 0, 0)
     }
-    return nil
 }
 
 func toPdfFont(style *xlsx.Style) string {
@@ -479,7 +671,7 @@ func getMergeSizesFromCell(cell *xlsx.Cell) (w, h float64) {
             cellIndex := indexCell(cell)
             rowIndex  := indexRow(cell.Row)
             if cell.HMerge > 0 {
-                for x := 1; x <= cell.HMerge; x++ {
+                for x := 1; x <= cell.HMerge && cellIndex+x < len(sheet.Cols); x++ {
                     col := sheet.Cols[cellIndex+x]
                     if col != nil {
                         w += col.Width
@@ -487,7 +679,7 @@ func getMergeSizesFromCell(cell *xlsx.Cell) (w, h float64) {
                 }  
             }
             if cell.VMerge > 0 {
-                for y := 1; y <= cell.VMerge; y++ {
+                for y := 1; y <= cell.VMerge && rowIndex+y < len(sheet.Rows); y++ {
                     row := sheet.Rows[rowIndex+y]
                     if row != nil {
                         h += row.Height
@@ -530,298 +722,286 @@ func getSheetWidth(sheet *xlsx.Sheet) float64 {
 
 
 // Write (XlsxTemplateFile) - пишем результат в io.Writer
+// Настройки вкладок шаблона (печать, вид, проверка данных, автофильтр, условное форматирование),
+// таблицы и имена книги переносятся в результат с учетом добавленных строк,
+// ячейки с фрагментами форматированного текста пишутся строками с форматированием
 func (s *XlsxTemplateFile) Write(writer io.Writer) error {
+    file := s.result
+    if file == nil {
+        file = s.template
+    }
+    if file == nil {
+        return errors.New("Not load template xlsx file")
+    }
+    parts, err := file.MarshallParts()
+    if err != nil {
+        return err
+    }
+    rows := s.rows
+    if s.result == nil {
+        rows = nil
+    }
+    if err := s.parts.patch(parts, s.template, file, rows); err != nil {
+        return err
+    }
+    rich := s.rich
+    if s.result == nil {
+        rich = nil
+    }
+    patchRich(parts, file, rich)
     if s.result != nil {
-        return s.result.Write(writer)
-    } else if s.template != nil {
-        return s.template.Write(writer)
+        patchOutline(parts, file, s.outline)
+        // Ограничение объема результата (RenderOptions.MaxBytes)
+        writer = newLimitWriter(writer, s.maxBytes)
+    }
+    return writeParts(parts, writer)
+}
+
+// LoadOption - опция загрузки шаблона
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+    wrapText  bool
+    whiteFill bool
+}
+
+// WithWrapText - перенос текста во всех ячейках шаблона со стилем
+func WithWrapText() LoadOption {
+    return func(o *loadOptions) {
+        o.wrapText = true
+    }
+}
+
+// WithWhiteFill - белая заливка ячеек шаблона без заливки
+func WithWhiteFill() LoadOption {
+    return func(o *loadOptions) {
+        o.whiteFill = true
     }
-    return errors.New("Not load template xlsx file")
 }
 
 // OpenTemplate - открыть файл шаблона
-func OpenTemplate(filename string) (*XlsxTemplateFile, error) {
+// По умолчанию шаблон не изменяется, правки стилей включаются опциями (WithWrapText, WithWhiteFill)
+func OpenTemplate(filename string, opts ...LoadOption) (*XlsxTemplateFile, error) {
     file, err := xlsx.OpenFile(filename)
     if err != nil {
         return nil, err
     }
-    // Пробигаемся по ячейкам шаблона и проводим тестирование фона
-    for _, sheet := range file.Sheets {
-        for _, row := range sheet.Rows {
-            for _, cell := range row.Cells {
-                if style := cell.GetStyle(); style != nil {
-                    style.Alignment.WrapText = true
-                    if len(style.Fill.FgColor) < 1 {
-                        style.Fill.FgColor = "FFFFFFFF"
+    var o loadOptions
+    for _, opt := range opts {
+        opt(&o)
+    }
+    if o.wrapText || o.whiteFill {
+        // Пробигаемся по ячейкам шаблона и правим стили
+        for _, sheet := range file.Sheets {
+            for _, row := range sheet.Rows {
+                for _, cell := range row.Cells {
+                    if style := cell.GetStyle(); style != nil {
+                        if o.wrapText {
+                            style.Alignment.WrapText = true
+                        }
+                        if o.whiteFill && len(style.Fill.FgColor) < 1 {
+                            style.Fill.FgColor = "FFFFFFFF"
+                        }
                         cell.SetStyle(style)
                     }
                 }
             }
         }
     }
-    return &XlsxTemplateFile{template: file}, nil
+    parts, err := readTemplateParts(filename)
+    if err != nil {
+        return nil, err
+    }
+    applyTemplateRuns(file, parts)
+    return &XlsxTemplateFile{template: file, parts: parts}, nil
 }
 
 // RenderTemplate (XlsxTemplateFile) рендер интрефейса в шаблон
+// Паника при рендере (некорректные данные или шаблон) возвращается как ошибка
 func (s *XlsxTemplateFile) RenderTemplate(v interface{}) error {
+    return s.RenderContext(context.Background(), v, RenderOptions{})
+}
+
+// RenderContext (XlsxTemplateFile) рендер интрефейса в шаблон с возможностью отмены
+// и ограничениями размера результата (превышение - ошибка *LimitError).
+// Ограничение объема (MaxBytes) проверяется при записи результата (Write, Save)
+func (s *XlsxTemplateFile) RenderContext(ctx context.Context, v interface{}, opts RenderOptions) (err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            s.result, s.rows, s.rich = nil, nil, nil
+            err = fmt.Errorf("Render template: %v", r)
+        }
+    }()
     if s.template != nil {
+        s.maxBytes = opts.MaxBytes
+        guard := &renderGuard{ctx: ctx, opts: opts}
+        if err := guard.sheets(outputSheets(s.template)); err != nil {
+            s.result = nil
+            return err
+        }
         s.result = xlsx.NewFile()
-        // Проходимся по вкладкам        
+        s.rows = make([]*rowMap, len(s.template.Sheets))
+        s.rich = make(richText)
+        var meter *textMeter
+        if s.autoFit {
+            meter = newTextMeter(s.fontDir)
+        }
+        // Проходимся по вкладкам (вкладки только с шаблонами строк {{#define}} не выводятся)
         for sheetIndex, sheet := range s.template.Sheets {
+            if isDefinesSheet(sheet) {
+                continue
+            }
             newSheet, err := s.result.AddSheet(sheet.Name)
             if err != nil {
                 s.result = nil
                 return err
             }
             cloneSheet(sheet, newSheet)
-            // Получаем объект
-            obj := getObject(v, sheetIndex)
-            // Раскладываем объект на граф
-            graph := new(node)
-            graph.FromObject(v)
-            // Вывод для теста
-            lines := graph.ListMap()            
-            // Проходимся по строкам
-            for _, row := range sheet.Rows {
-                // Проверка на массив или срез
-                if !haveArrayInRow(row, obj) {                    
-                    newRow := newSheet.AddRow(); cloneRow(row, newRow)
-                    if err := renderRow(newRow, obj); err != nil {
-                        return nil
-                    }
-                    continue
-                }
-                for i := 0; i < len(lines); i++ {
-                    newRow := newSheet.AddRow()
-                    cloneRow(row, newRow)                    
-                    if err := renderRow(newRow, lines[i]); err != nil {
-                        return nil
-                    }
-                }
+            if s.rows[sheetIndex], err = s.renderSheet(sheet, newSheet, getObject(v, sheetIndex), nil, guard); err != nil {
+                s.result = nil
+                return err
+            }
+            // Убираем индексы [index:1] и проверяем на [BR], выделяем фрагменты форматированного текста
+            for _, row := range newSheet.Rows {
+                finishRow(row)
+                extractRich(row, s.rich)
+            }
+            if meter != nil {
+                autoFitSheet(newSheet, autoWidthColumns(sheet), s.rich, meter)
             }
-            graph = nil
-
-            // Убираем индексы [index:1] и проверяем на [BR]         
-            for _,row := range newSheet.Rows {
-                boldRight := false
-                for _,cell := range row.Cells {
-                    if cell != nil {
-                        if len(cell.Value) > 0 {
-                            if rxMergeIndex.MatchString(cell.Value) {                        
-                                cell.Value = rxMergeIndex.ReplaceAllString(cell.Value, "")
-                            }
-                            if rxBrCellV.MatchString(cell.Value) {
-                                cell.Value = rxBrCellV.ReplaceAllString(cell.Value, "")
-                                boldRight = !boldRight                            
-                            }
-                            if boldRight && len(cell.Value) > 0 {    
-                                if style := cell.GetStyle(); style != nil {                                    
-                                    boldRightStyle := xlsx.NewStyle()                                    
-                                    boldRightStyle.ApplyAlignment         = style.ApplyAlignment
-                                    boldRightStyle.ApplyBorder            = style.ApplyBorder
-                                    boldRightStyle.ApplyFill              = style.ApplyFill
-                                    boldRightStyle.ApplyFont              = style.ApplyFont                                    
-
-                                    if !boldRightStyle.ApplyFont {
-                                        boldRightStyle.ApplyFont = true
-                                    } 
-
-                                    boldRightStyle.Border.Bottom        = style.Border.Bottom
-                                    boldRightStyle.Border.BottomColor   = style.Border.BottomColor
-                                    boldRightStyle.Border.Left          = style.Border.Left
-                                    boldRightStyle.Border.LeftColor     = style.Border.LeftColor
-                                    boldRightStyle.Border.Top           = style.Border.Top
-                                    boldRightStyle.Border.TopColor      = style.Border.TopColor
-                                    boldRightStyle.Border.Right         = style.Border.Right
-                                    boldRightStyle.Border.RightColor    = style.Border.RightColor 
-
-                                    boldRightStyle.Alignment.Horizontal   = style.Alignment.Horizontal
-                                    boldRightStyle.Alignment.Indent       = style.Alignment.Indent
-                                    boldRightStyle.Alignment.ShrinkToFit  = style.Alignment.ShrinkToFit
-                                    boldRightStyle.Alignment.TextRotation = style.Alignment.TextRotation
-                                    boldRightStyle.Alignment.Vertical     = style.Alignment.Vertical
-                                    boldRightStyle.Alignment.WrapText     = style.Alignment.WrapText                                    
-
-                                    boldRightStyle.Fill.BgColor     = style.Fill.BgColor
-                                    boldRightStyle.Fill.FgColor     = style.Fill.FgColor
-                                    boldRightStyle.Fill.PatternType = style.Fill.PatternType 
-
-                                    boldRightStyle.Font.Bold      = true
-                                    boldRightStyle.Font.Charset   = style.Font.Charset
-                                    boldRightStyle.Font.Color     = style.Font.Color
-                                    boldRightStyle.Font.Family    = style.Font.Family
-                                    boldRightStyle.Font.Italic    = style.Font.Italic
-                                    boldRightStyle.Font.Name      = style.Font.Name
-                                    boldRightStyle.Font.Size      = style.Font.Size
-                                    boldRightStyle.Font.Underline = style.Font.Underline   
-                                    cell.SetStyle(boldRightStyle)                                                           
-                                }                                                                                    
-                            }
-                        }
-                    }
-                }
-            }         
         }
         return nil
     }
     return errors.New("Not load template xlsx file")
 }
 
-/* Вспомогательные функции */
-
-// node - элeмент графа
-type node struct {
-    name     string
-    values   map[string]interface{}    
-    nodes []*node
-}
-
-func (n *node) String() string {    
-    return fmt.Sprintln(n.ListMap()) 
-}
-
-func (n *node) ListMap() []map[string]interface{} {
-    var m = make([]map[string]interface{}, 0)
-    n.toListMap("", make(map[string]interface{}), &m)
-    return m
-} 
-
-func (n *node) toListMap(name string, current map[string]interface{}, out *[]map[string]interface{}) {
-    for key, value := range n.values {
-        if len(n.name) > 0 {
-            key = n.name + "_" + key
-        } 
-        if len(name) > 0 {
-            key = name + "_" + key
-        }
-        current[key] = value
+// renderSheet (XlsxTemplateFile) - рендер строк вкладки шаблона в новую вкладку
+// При потоковой записи (out) строки записываются и удаляются из вкладки сразу после рендера,
+// guard - отмена и ограничения рендера (может быть nil).
+// Возвращает строки результата по строкам шаблона (при потоковой записи - nil)
+func (s *XlsxTemplateFile) renderSheet(sheet, newSheet *xlsx.Sheet, obj interface{}, out *rowStream, guard *renderGuard) (*rowMap, error) {
+    // Разбираем строки шаблона на строки и блоки
+    blocks, err := parseBlocks(sheet.Rows)
+    if err != nil {
+        return nil, err
     }
-    if len(n.nodes) > 0 {
-        path := name
-        if len(n.name) > 0 {
-            if len(path) > 0 {
-                path += "_"
-            } 
-            path += n.name
-        }
-        // Проходимся и формируем счетчик
-        var counter = make(map[string]int)        
-        for _, node := range n.nodes {
-            nname := path
-            if len(nname) > 0 {
-                if len(node.name) > 0 {
-                    nname += "_"
-                }                 
-            }
-            nname += node.name            
-            if cv, ok := counter[nname+"_length"]; ok {
-                counter[nname+"_length"] = cv + 1
-            } else { 
-                counter[nname+"_length"] = 1
+    root := newScope(obj)
+    root.less = s.keyOrder
+    root.stream = out
+    root.guard = guard
+    root.outline = s.outline != OutlineNone
+    if root.defines, err = parseDefines(s.template); err != nil {
+        return nil, err
+    }
+    var rows *rowMap
+    if out == nil {
+        rows = newRowMap(sheet.Rows)
+        root.rows = rows
+    }
+    // Строки данных таблиц Excel привязываются к коллекциям с именами таблиц
+    if sp := s.parts.sheet(sheet.Name); sp != nil {
+        blocks = bindTables(blocks, sheet.Rows, sp.tables, obj, s.keyOrder, rows)
+    }
+    // Проходимся по строкам
+    for _, b := range blocks {
+        if b.row == nil {
+            if err := renderBlock(b, root, newSheet); err != nil {
+                return nil, err
             }
+            continue
         }
-        for key, cv := range counter {
-            current[key] = cv
-        }
-        // Формируем строки
-        for _, node := range n.nodes {
-            var nw = make(map[string]interface{})
-            for k,v := range current {
-                nw[k] = v
-            }       
-            node.toListMap(path, nw, out)
+        // Строка привязывается к одной цепочке коллекций (по значениям данных)
+        if err := renderCollectionRow(b.row, root, newSheet); err != nil {
+            return nil, err
         }
-    } else {
-        *out = append(*out, current)
     }
+    return rows, nil
 }
 
-func (n* node) FromObject(obj interface{}) {
-    if n.values == nil {
-        n.values = make(map[string]interface{}, 0)
-    }
-    if n.nodes == nil {
-        n.nodes = make([]*node, 0)
-    }
-    val := reflect.ValueOf(obj)
-    kind := val.Type().Kind()
-    if kind == reflect.Ptr || kind == reflect.Interface {
-        val  = val.Elem()
-        kind = val.Type().Kind()
-    }
-    if kind == reflect.Struct {
-        t := val.Type()
-        for i := 0; i < t.NumField(); i++ {
-            field := t.Field(i)
-            fv := val.FieldByIndex(field.Index)
-            kind = fv.Type().Kind()
-            if kind == reflect.Ptr || kind == reflect.Interface {
-                fv  = fv.Elem()
-                kind = fv.Type().Kind()
-            }
-            if kind == reflect.Map {
-                node := new(node)
-                node.name = field.Name
-                node.FromObject(fv.Interface())
-                n.nodes = append(n.nodes, node)
-            } else if kind == reflect.Array || kind == reflect.Slice {                
-                for j := 0; j < fv.Len(); j++ {
-                    node := new(node)
-                    node.name = field.Name
-                    node.FromObject(fv.Index(j).Interface())
-                    n.nodes = append(n.nodes, node)
+// finishRow - убираем индексы [index:1] и метки [auto-width], выделяем жирным ячейки между метками [BR]
+func finishRow(row *xlsx.Row) {
+    boldRight := false
+    for _,cell := range row.Cells {
+        if cell != nil {
+            if len(cell.Value) > 0 {
+                if rxAutoWidth.MatchString(cell.Value) {
+                    cell.Value = rxAutoWidth.ReplaceAllString(cell.Value, "")
                 }
-            } else {
-                n.values[field.Name] = val.FieldByIndex(field.Index).Interface()
-            }
-        }
-    } else if kind == reflect.Map {
-        for _, key := range val.MapKeys() {
-            mapItem := val.MapIndex(key)
-            kind = mapItem.Type().Kind()
-            if kind == reflect.Ptr || kind == reflect.Interface {
-                mapItem  = mapItem.Elem()
-                kind = mapItem.Type().Kind()
-            }
-            if kind == reflect.Map {
-                node := new(node)
-                node.name = key.String()
-                node.FromObject(mapItem.Interface())
-                n.nodes = append(n.nodes, node)
-            } else if kind == reflect.Array || kind == reflect.Slice {                
-                for j := 0; j < mapItem.Len(); j++ {
-                    node := new(node)
-                    node.name = key.String()
-                    node.FromObject(mapItem.Index(j).Interface())
-                    n.nodes = append(n.nodes, node)
+                if rxMergeIndex.MatchString(cell.Value) {                        
+                    cell.Value = rxMergeIndex.ReplaceAllString(cell.Value, "")
+                }
+                if rxBrCellV.MatchString(cell.Value) {
+                    cell.Value = rxBrCellV.ReplaceAllString(cell.Value, "")
+                    boldRight = !boldRight                            
+                }
+                if boldRight && len(cell.Value) > 0 {    
+                    if style := cell.GetStyle(); style != nil {                                    
+                        boldRightStyle := xlsx.NewStyle()                                    
+                        boldRightStyle.ApplyAlignment         = style.ApplyAlignment
+                        boldRightStyle.ApplyBorder            = style.ApplyBorder
+                        boldRightStyle.ApplyFill              = style.ApplyFill
+                        boldRightStyle.ApplyFont              = style.ApplyFont                                    
+
+                        if !boldRightStyle.ApplyFont {
+                            boldRightStyle.ApplyFont = true
+                        } 
+
+                        boldRightStyle.Border.Bottom        = style.Border.Bottom
+                        boldRightStyle.Border.BottomColor   = style.Border.BottomColor
+                        boldRightStyle.Border.Left          = style.Border.Left
+                        boldRightStyle.Border.LeftColor     = style.Border.LeftColor
+                        boldRightStyle.Border.Top           = style.Border.Top
+                        boldRightStyle.Border.TopColor      = style.Border.TopColor
+                        boldRightStyle.Border.Right         = style.Border.Right
+                        boldRightStyle.Border.RightColor    = style.Border.RightColor 
+
+                        boldRightStyle.Alignment.Horizontal   = style.Alignment.Horizontal
+                        boldRightStyle.Alignment.Indent       = style.Alignment.Indent
+                        boldRightStyle.Alignment.ShrinkToFit  = style.Alignment.ShrinkToFit
+                        boldRightStyle.Alignment.TextRotation = style.Alignment.TextRotation
+                        boldRightStyle.Alignment.Vertical     = style.Alignment.Vertical
+                        boldRightStyle.Alignment.WrapText     = style.Alignment.WrapText                                    
+
+                        boldRightStyle.Fill.BgColor     = style.Fill.BgColor
+                        boldRightStyle.Fill.FgColor     = style.Fill.FgColor
+                        boldRightStyle.Fill.PatternType = style.Fill.PatternType 
+
+                        boldRightStyle.Font.Bold      = true
+                        boldRightStyle.Font.Charset   = style.Font.Charset
+                        boldRightStyle.Font.Color     = style.Font.Color
+                        boldRightStyle.Font.Family    = style.Font.Family
+                        boldRightStyle.Font.Italic    = style.Font.Italic
+                        boldRightStyle.Font.Name      = style.Font.Name
+                        boldRightStyle.Font.Size      = style.Font.Size
+                        boldRightStyle.Font.Underline = style.Font.Underline   
+                        cell.SetStyle(boldRightStyle)                                                           
+                    }                                                                                    
                 }
-            } else {
-                n.values[key.String()] = mapItem.Interface()
-            }
-        }
-    } else if kind == reflect.Array || kind == reflect.Slice {
-        for i := 0; i < val.Len(); i++ {
-            node := new(node)
-            node.name = n.name
-            if len(node.name) > 0 {
-                node.name += "_"+strconv.FormatInt(int64(i),10)
             }
-            node.FromObject(val.Index(i).Interface())
-            n.nodes = append(n.nodes, node)
         }
     }
 }
 
+/* Вспомогательные функции */
 
 func getObject(v interface{}, index int) interface{} {
-    val := reflect.ValueOf(v)
-    if val.Type().Kind() == reflect.Ptr {
-        val = val.Elem()
+    // Источник данных используется для всех вкладок
+    if _, ok := v.(DataSource); ok {
+        return v
+    }
+    val := indirect(reflect.ValueOf(v))
+    if !val.IsValid() {
+        return nil
     }
     if val.Type().Kind() == reflect.Slice || val.Type().Kind() == reflect.Array {
-        val = val.Index(index)
+        // Для вкладок без данных - пустой объект
+        if index >= val.Len() {
+            return nil
+        }
+        return val.Index(index).Interface()
     }
-    return val.Interface()
+    // Ссылка сохраняется для методов с приемником-ссылкой
+    return v
 }
 
 // cloneCell - клонирование ячейки
@@ -882,113 +1062,573 @@ func indexCell(cell *xlsx.Cell) int {
 }
 
 // renderCell - рендер ячейки
+// Ячейка из одного значения колонки запроса ({{Amount}}) с числом или датой записывается числом
+// (формат шаблона сохраняется), остальные значения выводятся текстом
 func renderCell(cell *xlsx.Cell, v interface{}) error {	    
+    if ctx, ok := v.(map[string]interface{}); ok {
+        if key, ok := singleValueKey(cell.Value); ok && typedKeys(ctx)[key] && setCellValue(cell, ctx[key]) {
+            return nil
+        }
+    }
     // Правки для совместимости шаблонизатора
-    tpl := strings.Replace(cell.Value, "{{", "{{{", -1)
-	tpl = strings.Replace(tpl, "}}", "}}}", -1)
-    tpl = strings.Replace(tpl,".","_",-1)
-    tpl = strings.Replace(tpl,":length","_length",-1)
+    tpl := prepareTemplate(cell.Value)
     // Обработка контента
     out, err := raymond.Render(tpl, v)
 	if err != nil {
 		return err
 	}
     cell.Value = out  
-    // Если у поля есть флаг авто мерджинга, то начинаем проверку   
-    if rxMergeCellV.MatchString(cell.Value) {
+	return nil
+}
+
+// singleValueKey - имя значения в контексте рендера, если ячейка состоит из одного выражения-пути
+func singleValueKey(value string) (string, bool) {
+    value = strings.TrimSpace(value)
+    match := rxTemplateExpr.FindStringSubmatch(value)
+    if match == nil || match[0] != value {
+        return "", false
+    }
+    tokens := rxExprToken.FindAllString(match[1], -1)
+    if len(tokens) != 1 || !isExprPath(tokens[0]) || !rxExprPath.MatchString(tokens[0]) {
+        return "", false
+    }
+    return contextKey(tokens[0]), true
+}
+
+// typedKeysName - ключ контекста рендера с именами значений из колонок запроса
+const typedKeysName = "@@typed"
+
+// typedKeys - имена значений контекста, которые записываются в ячейки с типом
+func typedKeys(ctx map[string]interface{}) map[string]bool {
+    keys, ok := ctx[typedKeysName].(map[string]bool)
+    if !ok {
+        keys = make(map[string]bool)
+        ctx[typedKeysName] = keys
+    }
+    return keys
+}
+
+// maxExactInt - целые больше 2^53 по модулю не представимы в Excel точно и выводятся текстом
+const maxExactInt = 1 << 53
+
+// timeFormat - формат ячейки для времени без даты (колонки TIME)
+const timeFormat = "h:mm:ss"
+
+// setCellValue - запись числа или даты в ячейку с типом, false - значение выводится текстом
+// Формат шаблона сохраняется (для дат - если задан), текстовый формат (@) оставляет текст
+func setCellValue(cell *xlsx.Cell, value interface{}) bool {
+    if value == nil || cell.NumFmt == "@" {
+        return false
+    }
+    if t, ok := value.(time.Time); ok {
+        if t.IsZero() {
+            cell.Value = ""
+            return true
+        }
+        // Время без даты (0000-01-01) - доля суток
+        if t.Year() == 0 && t.Month() == time.January && t.Day() == 1 {
+            h, m, sec := t.Clock()
+            day := (float64(h*3600+m*60+sec) + float64(t.Nanosecond())/1e9) / 86400
+            numFmt := timeFormat
+            if len(cell.NumFmt) > 0 && !strings.EqualFold(cell.NumFmt, "general") {
+                numFmt = cell.NumFmt
+            }
+            cell.SetFloatWithFormat(day, numFmt)
+            return true
+        }
+        if t.Year() < 1900 {
+            return false
+        }
+        numFmt := cell.NumFmt
+        options := xlsx.DefaultDateTimeOptions
+        if h, m, sec := t.Clock(); h == 0 && m == 0 && sec == 0 && t.Nanosecond() == 0 {
+            options = xlsx.DefaultDateOptions
+        }
+        // Дата выводится как есть, без перевода в UTC
+        options.Location = t.Location()
+        cell.SetDateWithOptions(t, options)
+        if len(numFmt) > 0 && !strings.EqualFold(numFmt, "general") {
+            cell.NumFmt = numFmt
+        }
+        return true
+    }
+    v := reflect.ValueOf(value)
+    switch v.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        if n := v.Int(); n > maxExactInt || n < -maxExactInt {
+            return false
+        }
+        setCellNumber(cell, v.Int())
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        if v.Uint() > maxExactInt {
+            return false
+        }
+        setCellNumber(cell, int64(v.Uint()))
+    case reflect.Float32, reflect.Float64:
+        if f := v.Float(); !math.IsNaN(f) && !math.IsInf(f, 0) {
+            setCellNumber(cell, f)
+        } else {
+            return false
+        }
+    default:
+        return false
+    }
+    return true
+}
+
+// cellText - текст ячейки для вывода: числа и даты - в формате ячейки
+func cellText(cell *xlsx.Cell) string {
+    if t := cell.Type(); t == xlsx.CellTypeNumeric || t == xlsx.CellTypeDate {
+        if text, err := cell.FormattedValue(); err == nil {
+            return text
+        }
+    }
+    return cell.Value
+}
+
+// mergeRowCells - объединение ячеек строки с флагами [v-merge] и [h-merge]
+// [v-merge:B] - объединять по вертикали только при равенстве значений в колонке B
+func mergeRowCells(row *xlsx.Row) {
+    ir := indexRow(row)
+    hRun := -1
+    for ic, cell := range row.Cells {
+        // Объединение по горизонтали с предыдущей ячейкой с таким же значением
+        if rxMergeCellH.MatchString(cell.Value) {
+            cell.Value = rxMergeCellH.ReplaceAllString(cell.Value, "")
+            if hRun >= 0 && len(strings.TrimSpace(cell.Value)) > 0 && row.Cells[hRun].Value == cell.Value {
+                row.Cells[hRun].HMerge = ic-hRun
+            } else {
+                hRun = ic
+            }
+        } else {
+            hRun = -1
+        }
+        // Если у поля есть флаг авто мерджинга, то начинаем проверку   
+        match := rxMergeCellV.FindStringSubmatch(cell.Value)
+        if match == nil {
+            continue
+        }
         cell.Value = rxMergeCellV.ReplaceAllString(cell.Value, "")
-        if len(strings.TrimSpace(cell.Value)) > 0 {
-            // Проверяем значения
-            ic, ir := indexCell(cell), indexRow(cell.Row)
-            if ir >= 0 && ic >= 0 {
-                var lastRow *xlsx.Row
-                for i := (ir-1); i >= 0; i-- {
-                    row := cell.Row.Sheet.Rows[i]
-                    if row.Cells[ic].Value == cell.Value {
-                        lastRow = row
-                    } else {
-                        break
-                    }
-                }
-                if lastRow != cell.Row {
-                    ilr := indexRow(lastRow)
-                    if ilr >= 0 {
-                        lastRow.Cells[ic].VMerge = ir-ilr
-                    }
-                }
+        if len(strings.TrimSpace(cell.Value)) < 1 || ir < 0 {
+            continue
+        }
+        byCol := -1
+        if len(match[1]) > 0 {
+            byCol = xlsx.ColLettersToIndex(strings.ToUpper(match[1]))
+        }
+        // Проверяем значения
+        var lastRow *xlsx.Row
+        for i := (ir-1); i >= 0; i-- {
+            prev := row.Sheet.Rows[i]
+            if ic >= len(prev.Cells) || prev.Cells[ic].Value != cell.Value {
+                break
             }
+            if byCol >= 0 && (byCol >= len(prev.Cells) || byCol >= len(row.Cells) ||
+                prev.Cells[byCol].Value != row.Cells[byCol].Value) {
+                break
+            }
+            lastRow = prev
+        }
+        if ilr := indexRow(lastRow); ilr >= 0 {
+            lastRow.Cells[ic].VMerge = ir-ilr
         }
     }
-	return nil
+}
+
+// markMergeParent - [v-merge:parent] превращаем в [v-merge] с номером области родительского элемента,
+// чтобы объединялись только ячейки одного родителя
+func markMergeParent(row *xlsx.Row, v interface{}) {
+    ctx, ok := v.(map[string]interface{})
+    for _, cell := range row.Cells {
+        if !rxMergeParent.MatchString(cell.Value) {
+            continue
+        }
+        marker := "[v-merge]"
+        if paths := templatePaths(cell.Value); ok && len(paths) > 0 {
+            path := strings.Split(paths[0], ".")
+            if owner, found := ctx["@"+strings.Join(path[:len(path)-1], "_")].(*scope); found {
+                marker += "[index:" + strconv.FormatUint(owner.id, 10) + "]"
+            }
+        }
+        cell.Value = rxMergeParent.ReplaceAllString(cell.Value, marker)
+    }
+}
+
+// prepareTemplate - правки выражений {{...}} для совместимости шаблонизатора
+// (без экранирования, вложенные имена через "_"), текст вне выражений не меняется
+func prepareTemplate(value string) string {
+    return rxTemplateExpr.ReplaceAllStringFunc(value, func(expr string) string {
+        tokens := rxExprToken.FindAllString(rxTemplateExpr.FindStringSubmatch(expr)[1], -1)
+        for i, token := range tokens {
+            if match := rxExprHashArg.FindStringSubmatch(token); match != nil {
+                tokens[i] = match[1] + "=" + exprArg(match[2])
+            } else {
+                tokens[i] = exprArg(token)
+            }
+        }
+        return "{{{" + strings.Join(tokens, " ") + "}}}"
+    })
+}
+
+// exprArg - аргумент выражения: литералы без изменений, пути - в имена контекста
+func exprArg(token string) string {
+    if !isExprPath(token) {
+        return token
+    }
+    return contextKey(token)
+}
+
+// isExprPath - является ли аргумент выражения путем к значению (не литералом)
+func isExprPath(token string) bool {
+    if len(token) < 1 || token[0] == '"' || token[0] == '\'' || token == "true" || token == "false" {
+        return false
+    }
+    if _, err := strconv.ParseFloat(token, 64); err == nil {
+        return false
+    }
+    return true
+}
+
+// templatePaths - пути к значениям во всех выражениях {{...}} строки
+// ({{Items.Name}}, {{default Items.Name "-"}}, {{../@number}}, {{Items:length}})
+func templatePaths(value string) []string {
+    var paths []string
+    for _, match := range rxTemplateExpr.FindAllStringSubmatch(value, -1) {
+        // Агрегаты вычисляются отдельно и не привязывают строку к коллекции
+        if rxAggregate.MatchString(match[0]) {
+            continue
+        }
+        tokens := rxExprToken.FindAllString(match[1], -1)
+        if len(tokens) > 1 {
+            // Первый аргумент - имя хелпера
+            tokens = tokens[1:]
+        }
+        for _, token := range tokens {
+            if m := rxExprHashArg.FindStringSubmatch(token); m != nil {
+                token = m[2]
+            }
+            if isExprPath(token) && rxExprPath.MatchString(token) {
+                paths = append(paths, token)
+            }
+        }
+    }
+    return paths
+}
+
+// contextKey - имя значения в контексте рендера для выражения шаблона
+// (Items.Name -> Items_Name, ../@number -> _up__at_number)
+func contextKey(expr string) string {
+    if expr == "this" || strings.HasPrefix(expr, "this.") {
+        expr = "_" + expr
+    }
+    expr = strings.Replace(expr, "../", "_up_", -1)
+    expr = strings.Replace(expr, "@", "_at_", -1)
+    expr = strings.Replace(expr, ".", "_", -1)
+    expr = strings.Replace(expr, ":length", "_length", -1)
+    return expr
 }
 
 // Рендер строки
 func renderRow(row *xlsx.Row, v interface{}) error {
+    markMergeParent(row, v)
 	for _, cell := range row.Cells {
 		err := renderCell(cell, v)
 		if err != nil {
 			return err
 		}
 	}
+    mergeRowCells(row)
 	return nil
 }
 
-// haveArrayInRow - содержится ли массив в строке
-func haveArrayInRow(row *xlsx.Row, v interface{}) bool {
-    if row != nil {
-        // Обнодим все ячейки в строке и проверяем наличие массива
-        for _, cell := range row.Cells {
-            if match := rxTemplateItem.FindStringSubmatch(cell.Value); match != nil && len(match) > 1 {                
-                names := strings.Split(match[1], ".")
-                if len(names) > 0 {
-                    t := reflect.TypeOf(v)
-                    for _, name := range names {
-                        t := findType(t, name)
-                        if t != nil {
-                            if t.Kind() == reflect.Array || t.Kind() == reflect.Slice {
-                                return true
-                            }
-                        } else {
-                            break
-                        }
-                    }
+// rowLevel - ближайшая коллекция, к которой привязана строка вне блоков, от элемента области:
+// путь коллекции от области и итератор ее элементов (nil - строка больше не привязана к коллекциям).
+// Строка может ссылаться только на одну цепочку вложенных коллекций (Items, Items.SubItems),
+// для параллельных коллекций нужен блок {{#each Items zip=Payments}}
+func rowLevel(row *xlsx.Row, sc *scope) ([]string, Iterator, error) {
+    var level []string
+    var it Iterator
+    tried := make(map[string]bool)
+    for _, cell := range row.Cells {
+        if cell == nil {
+            continue
+        }
+        for _, expr := range templatePaths(cell.Value) {
+            if strings.HasSuffix(expr, ":length") || strings.HasPrefix(expr, "@") || strings.HasPrefix(expr, "../") {
+                continue
+            }
+            path := strings.Split(expr, ".")
+            if !hasPrefix(path, sc.path) {
+                continue
+            }
+            rest := path[len(sc.path):]
+            if it != nil && hasPrefix(rest, level) {
+                continue
+            }
+            next, nextIt := findCollection(sc.value, rest, sc.keyOrder(), tried)
+            if nextIt == nil {
+                continue
+            }
+            if it != nil {
+                closeIterator(it)
+                closeIterator(nextIt)
+                a := strings.Join(append(append([]string{}, sc.path...), level...), ".")
+                b := strings.Join(append(append([]string{}, sc.path...), next...), ".")
+                return nil, nil, fmt.Errorf("Row binds to several collections: %s, %s (use {{#each %s zip=%s}})", a, b, a, b)
+            }
+            level, it = next, nextIt
+        }
+    }
+    return level, it, nil
+}
+
+// findCollection - первая коллекция на пути от значения и итератор ее элементов
+// Коллекции определяются по значениям: у DataSource - через Iterate, иначе срезы, массивы
+// и потоковые источники (карты - поля, а не коллекции). tried - пути, уже не оказавшиеся коллекциями
+func findCollection(v reflect.Value, names []string, less func(a, b interface{}) bool, tried map[string]bool) ([]string, Iterator) {
+    for i, name := range names {
+        if ds, ok := asDataSource(v); ok {
+            for j := i+1; j <= len(names); j++ {
+                key := strings.Join(names[:j], ".")
+                if tried[key] {
+                    continue
+                }
+                if it := ds.Iterate(strings.Join(names[i:j], ".")); it != nil {
+                    return names[:j], it
                 }
+                tried[key] = true
             }
+            return nil, nil
+        }
+        // Геттер последнего имени вызывается только при подстановке, если его результат не коллекция
+        if i == len(names)-1 && !collectionGetter(v, name) {
+            return nil, nil
+        }
+        var ok bool
+        if v, ok = findValue(v, name); !ok {
+            return nil, nil
+        }
+        if e := indirect(v); e.IsValid() && e.Kind() == reflect.Map {
+            continue
+        }
+        if it := iterateValue(v, less); it != nil {
+            return names[:i+1], it
         }
     }
-    return false
+    return nil, nil
 }
 
+// collectionGetter - false, если имя - метод-геттер, результат которого не может быть коллекцией
+func collectionGetter(v reflect.Value, name string) bool {
+    if e := indirect(v); e.IsValid() {
+        if e.Kind() == reflect.Map {
+            return true
+        }
+        if e.Kind() == reflect.Struct {
+            if _, ok := e.Type().FieldByName(name); ok {
+                return true
+            }
+        }
+    }
+    receiver := methodReceiver(v)
+    if !receiver.IsValid() {
+        return true
+    }
+    if m := receiver.MethodByName(name); isGetter(m) {
+        return collectionType(m.Type().Out(0))
+    }
+    return true
+}
 
-// findType - получаем тип по имени
-func findType(t reflect.Type, name string) reflect.Type {
-    kind := t.Kind()
-    // Если это ссылка, то получаем истенный тип
-    if kind == reflect.Ptr || kind == reflect.Interface {
-        t = t.Elem()
+// renderCollectionRow - рендер строки вне блоков: строка повторяется для каждого элемента самой
+// вложенной коллекции пути (Items.SubItems), элементы родительских коллекций без вложенных
+// элементов выводятся одной строкой. Элементы обходятся по одному в областях видимости,
+// как в {{#each}}: доступны {{../Field}} и метаданные цикла по родителю
+func renderCollectionRow(row *xlsx.Row, sc *scope, sheet *xlsx.Sheet) error {
+    level, it, err := rowLevel(row, sc)
+    if err != nil {
+        return err
     }
-    kind = t.Kind()
-    if kind == reflect.Struct {
-        if field, ok := t.FieldByName(name); ok {
-            return field.Type
+    if it == nil {
+        return renderScopeRow(row, sc, sheet)
+    }
+    defer closeIterator(it)
+    path := append(append([]string{}, sc.path...), level...)
+    count := -1
+    if sized, ok := it.(sizedIterator); ok {
+        count = sized.Len()
+    }
+    next := it.Next()
+    if !next && sc.parent != nil {
+        if err := iteratorErr(it); err != nil {
+            return err
         }
-    } 
-    return nil
+        // Пустая вложенная коллекция - строка с пустым элементом, ../ указывает на родителя
+        empty := &scope{id: nextScopeID(), parent: sc, path: path, last: true, absolute: true}
+        return renderScopeRow(row, empty, sheet)
+    }
+    guard := sc.root().guard
+    for i := 0; next; i++ {
+        if err := guard.check(); err != nil {
+            return err
+        }
+        item := &scope{
+            id:       nextScopeID(),
+            parent:   sc,
+            path:     path,
+            value:    reflect.ValueOf(it.Value()),
+            index:    i,
+            count:    count,
+            key:      it.Key(),
+            absolute: true,
+        }
+        item.items = item.value
+        next = it.Next()
+        item.last = !next
+        if err := renderCollectionRow(row, item, sheet); err != nil {
+            return err
+        }
+    }
+    return iteratorErr(it)
 }
 
-// findValue - получаем тип по имени
+// findValue - получаем значение поля структуры или элемента карты по имени
+// Если поля нет, то вызывается метод-геттер без аргументов
+// Значения, реализующие DataSource, запрашиваются через Get
 func findValue(v reflect.Value, name string) (reflect.Value, bool) {
-    kind := v.Type().Kind()
-    // Если это ссылка, то получаем истенный тип
-    if kind == reflect.Ptr || kind == reflect.Interface {
-        v = v.Elem()
+    if ds, ok := asDataSource(v); ok {
+        value, ok := ds.Get(name)
+        return reflect.ValueOf(value), ok
+    }
+    receiver := v
+    v = indirect(v)
+    if !v.IsValid() {
+        return v, false
     }
-    kind = v.Type().Kind()
+    kind := v.Type().Kind()
     if kind == reflect.Struct {
         v := v.FieldByName(name)
+        if v.IsValid() && v.CanInterface() {
+            return v, true
+        }
+    } else if kind == reflect.Map && v.Type().Key().Kind() == reflect.String {
+        v := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
         if v.IsValid() {
             return v, true
-        }        
-    } 
+        }
+    }
+    if receiver = methodReceiver(receiver); receiver.IsValid() {
+        if m := receiver.MethodByName(name); isGetter(m) {
+            return m.Call(nil)[0], true
+        }
+    }
     return v, false
-}
\ No newline at end of file
+}
+
+// methodReceiver - значение, у которого доступны все методы (ссылка, если возможно)
+func methodReceiver(v reflect.Value) reflect.Value {
+    for v.IsValid() && v.Kind() == reflect.Interface {
+        if v.IsNil() {
+            return reflect.Value{}
+        }
+        v = v.Elem()
+    }
+    if !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil()) {
+        return reflect.Value{}
+    }
+    if v.Kind() != reflect.Ptr && v.CanAddr() {
+        v = v.Addr()
+    }
+    return v
+}
+
+// errorType - тип error (методы, возвращающие только ошибку, - не геттеры: Close, Validate)
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// isGetter - метод без аргументов, возвращающий одно значение (не error)
+func isGetter(m reflect.Value) bool {
+    return m.IsValid() && m.CanInterface() && m.Type().NumIn() == 0 && m.Type().NumOut() == 1 &&
+        m.Type().Out(0) != errorType
+}
+
+// displayValue - значение для вывода в ячейку
+// fmt.Stringer и encoding.TextMarshaler выводятся через свои методы, time.Time остается датой
+func displayValue(v reflect.Value) interface{} {
+    receiver := methodReceiver(v)
+    if !receiver.IsValid() || !receiver.CanInterface() {
+        return nil
+    }
+    if t, ok := indirect(receiver).Interface().(time.Time); ok {
+        return t
+    }
+    switch x := receiver.Interface().(type) {
+    case fmt.Stringer:
+        return x.String()
+    case encoding.TextMarshaler:
+        if text, err := x.MarshalText(); err == nil {
+            return string(text)
+        }
+    }
+    return indirect(receiver).Interface()
+}
+
+// findPath - получаем значение по пути из имен полей
+// Остаток пути от значения, реализующего DataSource, передается в Get целиком
+func findPath(v reflect.Value, path []string) (reflect.Value, bool) {
+    for i, name := range path {
+        if ds, ok := asDataSource(v); ok {
+            value, ok := ds.Get(strings.Join(path[i:], "."))
+            return reflect.ValueOf(value), ok
+        }
+        var ok bool
+        if v, ok = findValue(v, name); !ok {
+            return v, false
+        }
+    }
+    return v, true
+}
+
+// sortMapKeys - ключи карты в детерминированном порядке
+// (по умолчанию по возрастанию, либо в порядке less)
+func sortMapKeys(keys []reflect.Value, less func(a, b interface{}) bool) []reflect.Value {
+    sort.SliceStable(keys, func(i, j int) bool {
+        if less != nil {
+            return less(keys[i].Interface(), keys[j].Interface())
+        }
+        return compareOrder(keys[i], keys[j]) < 0
+    })
+    return keys
+}
+
+// isEmpty - пустое значение: nil, пустая строка, пустой массив, срез или карта
+func isEmpty(v reflect.Value) bool {
+    v = indirect(v)
+    if !v.IsValid() {
+        return true
+    }
+    switch v.Kind() {
+    case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+        return v.Len() == 0
+    }
+    return false
+}
+
+// indirect - разыменование ссылок и интерфейсов (nil дает невалидное значение)
+func indirect(v reflect.Value) reflect.Value {
+    for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+        if v.IsNil() {
+            return reflect.Value{}
+        }
+        v = v.Elem()
+    }
+    return v
+}
+
+// parseHashArgs - разбор именованных аргументов вида key="value" key2=value2
+func parseHashArgs(s string) map[string]string {
+    args := make(map[string]string)
+    for _, match := range rxHashArg.FindAllStringSubmatch(s, -1) {
+        args[match[1]] = unquote(match[2])
+    }
+    return args
+}
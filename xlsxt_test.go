@@ -0,0 +1,350 @@
+package xlsxt
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    "github.com/tealeg/xlsx"
+)
+
+// resultValues - значения ячеек вкладки результата
+func resultValues(sheet *xlsx.Sheet) [][]string {
+    var values [][]string
+    for _, row := range sheet.Rows {
+        var cells []string
+        for _, cell := range row.Cells {
+            cells = append(cells, cellText(cell))
+        }
+        values = append(values, cells)
+    }
+    return values
+}
+
+// renderTestValues - значения ячеек результата шаблона из строк rows по данным data
+func renderTestValues(t *testing.T, rows [][]string, data interface{}) [][]string {
+    tpl := newTestTemplate(rows)
+    if err := tpl.RenderTemplate(data); err != nil {
+        t.Fatal(err)
+    }
+    return resultValues(tpl.result.Sheets[0])
+}
+
+// checkValues - значения ячеек результата совпадают с ожидаемыми
+func checkValues(t *testing.T, got, want [][]string) {
+    t.Helper()
+    if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+        t.Errorf("values:\n got %q\nwant %q", got, want)
+    }
+}
+
+type mergeLine struct{ Name string }
+
+type mergeOrder struct {
+    Id     int
+    Status string
+    Lines  []mergeLine
+}
+
+// mergeFlags - объединения ячеек строки (v<n> - по вертикали, h<n> - по горизонтали)
+func mergeFlags(row *xlsx.Row) []string {
+    var flags []string
+    for _, cell := range row.Cells {
+        flag := ""
+        if cell.VMerge > 0 {
+            flag += fmt.Sprintf("v%d", cell.VMerge)
+        }
+        if cell.HMerge > 0 {
+            flag += fmt.Sprintf("h%d", cell.HMerge)
+        }
+        flags = append(flags, flag)
+    }
+    return flags
+}
+
+func TestVerticalMergeScopes(t *testing.T) {
+    tpl := newTestTemplate([][]string{
+        {"{{Orders.Status}}[v-merge:parent]", "{{Orders.Lines.Name}}", "{{Orders.Status}}[v-merge]", "{{Orders.Id}}", "{{Orders.Status}}[v-merge:d]"},
+    })
+    orders := []mergeOrder{{1, "new", []mergeLine{{"a"}, {"b"}}}, {2, "new", []mergeLine{{"c"}}}, {3, "done", []mergeLine{{"d"}}}}
+    if err := tpl.RenderTemplate(struct{ Orders []mergeOrder }{orders}); err != nil {
+        t.Fatal(err)
+    }
+    rows := tpl.result.Sheets[0].Rows
+    // [v-merge:parent] - только строки одного заказа, [v-merge] - все равные подряд,
+    // [v-merge:d] - при равенстве значений колонки D
+    want := [][]string{{"v1", "", "v2", "", "v1"}, {"", "", "", "", ""}, {"", "", "", "", ""}, {"", "", "", "", ""}}
+    for i, row := range rows {
+        if fmt.Sprint(mergeFlags(row)) != fmt.Sprint(want[i]) {
+            t.Errorf("row %d: %v, want %v", i, mergeFlags(row), want[i])
+        }
+    }
+    checkValues(t, resultValues(tpl.result.Sheets[0]), [][]string{
+        {"new", "a", "new", "1", "new"},
+        {"new", "b", "new", "1", "new"},
+        {"new", "c", "new", "2", "new"},
+        {"done", "d", "done", "3", "done"},
+    })
+}
+
+func TestVerticalMergeManyParents(t *testing.T) {
+    // Равные значения разных родителей не объединяются (номер родителя не повторяется)
+    var orders []mergeOrder
+    for i := 0; i < 500; i++ {
+        orders = append(orders, mergeOrder{i, "new", []mergeLine{{"a"}, {"b"}}})
+    }
+    tpl := newTestTemplate([][]string{{"{{Orders.Status}}[v-merge:parent]", "{{Orders.Lines.Name}}"}})
+    if err := tpl.RenderTemplate(struct{ Orders []mergeOrder }{orders}); err != nil {
+        t.Fatal(err)
+    }
+    for i, row := range tpl.result.Sheets[0].Rows {
+        want := 0
+        if i%2 == 0 {
+            want = 1
+        }
+        if row.Cells[0].VMerge != want {
+            t.Fatalf("row %d: v-merge %d", i, row.Cells[0].VMerge)
+        }
+    }
+}
+
+func TestHorizontalMerge(t *testing.T) {
+    tpl := newTestTemplate([][]string{{"x[h-merge]", "x[h-merge]", "x[h-merge]", "y[h-merge]", "[h-merge]", "[h-merge]"}})
+    if err := tpl.RenderTemplate(nil); err != nil {
+        t.Fatal(err)
+    }
+    row := tpl.result.Sheets[0].Rows[0]
+    if fmt.Sprint(mergeFlags(row)) != fmt.Sprint([]string{"h2", "", "", "", "", ""}) {
+        t.Errorf("flags: %v", mergeFlags(row))
+    }
+    checkValues(t, resultValues(tpl.result.Sheets[0]), [][]string{{"x", "x", "x", "y", "", ""}})
+}
+
+type keyItem struct {
+    Name   string
+    Amount int
+}
+
+var keyData = struct {
+    Prices map[string]float64
+    ByID   map[int]keyItem
+}{map[string]float64{"z": 1, "a": 2, "m": 3, "c": 4}, map[int]keyItem{10: {"ten", 1}, 2: {"two", 5}, 33: {"tt", 3}}}
+
+var keyRows = [][]string{
+    {"{{#each Prices}}"},
+    {"{{@key}}", "{{this}}"},
+    {"{{/each}}"},
+    {"{{#each ByID}}"},
+    {"{{@key}}", "{{Name}}"},
+    {"{{/each}}"},
+    {"{{#each ByID sort=-Amount}}"},
+    {"{{@key}}", "{{ByID.Name}}"},
+    {"{{/each}}"},
+}
+
+func TestMapKeyOrder(t *testing.T) {
+    // Ключи по возрастанию (числа - как числа), порядок не зависит от обхода карты
+    for i := 0; i < 5; i++ {
+        checkValues(t, renderTestValues(t, keyRows, keyData), [][]string{
+            {"a", "2"}, {"c", "4"}, {"m", "3"}, {"z", "1"},
+            {"2", "two"}, {"10", "ten"}, {"33", "tt"},
+            {"2", "two"}, {"33", "tt"}, {"10", "ten"},
+        })
+    }
+}
+
+func TestSetMapKeyOrder(t *testing.T) {
+    tpl := newTestTemplate(keyRows[:3])
+    tpl.SetMapKeyOrder(func(a, b interface{}) bool { return fmt.Sprint(a) > fmt.Sprint(b) })
+    if err := tpl.RenderTemplate(keyData); err != nil {
+        t.Fatal(err)
+    }
+    checkValues(t, resultValues(tpl.result.Sheets[0]), [][]string{{"z", "1"}, {"m", "3"}, {"c", "4"}, {"a", "2"}})
+    values := renderTestValues(t, [][]string{{"{{#each ByID sort=-@key}}"}, {"{{@key}}"}, {"{{/each}}"}}, keyData)
+    checkValues(t, values, [][]string{{"33"}, {"10"}, {"2"}})
+}
+
+type nilAddr struct{ City string }
+
+type nilItem struct {
+    Name string
+    Addr *nilAddr
+    Note *string
+}
+
+type nilDoc struct {
+    Title *string
+    Owner *nilAddr
+    Items []*nilItem
+    Tags  map[string]string
+    Any   interface{}
+}
+
+// panicDoc - геттер с паникой
+type panicDoc struct{}
+
+func (panicDoc) Broken() string { panic("broken") }
+
+var nilRows = [][]string{
+    {`{{default Title "—"}}`, "{{Owner.City}}", "{{default Owner.City 'n/a'}}", `{{default Any "x"}}`, "{{Tags.a}}"},
+    {"{{#each Items}}"},
+    {"{{Name}}", `{{default Addr.City "—"}}`, `{{default Note "-"}}`},
+    {"{{/each}}"},
+}
+
+func TestNilValues(t *testing.T) {
+    // nil-ссылки, карты и интерфейсы - пустые значения
+    for _, data := range []interface{}{nil, &nilDoc{}, (*nilDoc)(nil), []*nilDoc{nil}} {
+        checkValues(t, renderTestValues(t, nilRows, data), [][]string{{"—", "", "n/a", "x", ""}})
+    }
+    data := &nilDoc{Owner: &nilAddr{"Msk"}, Items: []*nilItem{nil, {Name: "a"}, {Name: "b", Addr: &nilAddr{"Spb"}}}}
+    checkValues(t, renderTestValues(t, nilRows, data), [][]string{
+        {"—", "Msk", "Msk", "x", ""},
+        {"", "—", "-"},
+        {"a", "—", "-"},
+        {"b", "Spb", "-"},
+    })
+}
+
+func TestPanicIsError(t *testing.T) {
+    tpl := newTestTemplate([][]string{{"{{Broken}}"}})
+    err := tpl.RenderTemplate(panicDoc{})
+    if err == nil || !strings.Contains(err.Error(), "broken") {
+        t.Errorf("error: %v", err)
+    }
+    if tpl.result != nil {
+        t.Error("result after panic")
+    }
+}
+
+type embedStatus int
+
+func (s embedStatus) String() string { return [...]string{"draft", "paid"}[s] }
+
+type embedCode struct{ v string }
+
+func (c embedCode) MarshalText() ([]byte, error) { return []byte("C-" + c.v), nil }
+
+type embedBase struct {
+    ID   int
+    Name string
+}
+
+type embedLine struct {
+    Qty, Price float64
+    St         embedStatus
+    Code       embedCode
+}
+
+func (l embedLine) Total() float64 { return l.Qty * l.Price }
+
+type embedDoc struct {
+    embedBase
+    Name   string
+    Lines  []embedLine
+    closed int
+}
+
+func (d *embedDoc) Count() int { return len(d.Lines) }
+
+// Close - не геттер (возвращает только ошибку)
+func (d *embedDoc) Close() error {
+    d.closed++
+    return nil
+}
+
+// Untouched - геттер, который не упомянут в шаблоне
+func (d *embedDoc) Untouched() int {
+    d.closed += 10
+    return 0
+}
+
+func TestEmbeddedFieldsAndGetters(t *testing.T) {
+    data := &embedDoc{embedBase: embedBase{7, "base"}, Name: "outer", Lines: []embedLine{{1, 2, 0, embedCode{"a"}}, {3, 4, 1, embedCode{"b"}}}}
+    values := renderTestValues(t, [][]string{
+        {"{{ID}}", "{{Name}}", "{{Count}}", "{{Close}}"},
+        {"{{Lines.Qty}}", "{{Lines.Total}}", "{{Lines.St}}", "{{Lines.Code}}"},
+        {"{{#each Lines sort=-Total}}"},
+        {"{{Total}}", "{{St}}", "{{Code}}", "{{../ID}}"},
+        {"{{/each}}"},
+        {"{{sum Lines.Total}}"},
+    }, data)
+    // Поля встроенной структуры - на уровне родителя (свое поле важнее), Stringer и TextMarshaler - текстом
+    checkValues(t, values, [][]string{
+        {"7", "outer", "2", ""},
+        {"1", "2", "draft", "C-a"},
+        {"3", "12", "paid", "C-b"},
+        {"12", "paid", "C-b", "7"},
+        {"2", "draft", "C-a", "7"},
+        {"14"},
+    })
+    // Вызываются только упомянутые геттеры, методы с ошибкой не вызываются
+    if data.closed != 0 {
+        t.Errorf("methods called: %d", data.closed)
+    }
+}
+
+// addTestSheet - еще одна вкладка шаблона
+func addTestSheet(tpl *XlsxTemplateFile, rows [][]string) {
+    sheet, _ := tpl.template.AddSheet(fmt.Sprintf("Sheet%d", len(tpl.template.Sheets)+1))
+    for _, values := range rows {
+        row := sheet.AddRow()
+        for _, value := range values {
+            cell := row.AddCell()
+            cell.Value = value
+            cell.SetStyle(xlsx.NewStyle())
+        }
+    }
+}
+
+// saveTestFile - файл шаблона во временном каталоге
+func saveTestFile(t *testing.T, file *xlsx.File) string {
+    filename := filepath.Join(t.TempDir(), "template.xlsx")
+    if err := file.Save(filename); err != nil {
+        t.Fatal(err)
+    }
+    return filename
+}
+
+func TestOpenTemplateKeepsStyles(t *testing.T) {
+    file := xlsx.NewFile()
+    sheet, _ := file.AddSheet("S1")
+    cell := sheet.AddRow().AddCell()
+    cell.Value = "{{Name}}"
+    style := xlsx.NewStyle()
+    style.Font.Bold = true
+    style.ApplyFont = true
+    cell.SetStyle(style)
+    filename := saveTestFile(t, file)
+
+    // По умолчанию шаблон не изменяется
+    tpl, err := OpenTemplate(filename)
+    if err != nil {
+        t.Fatal(err)
+    }
+    style = tpl.template.Sheets[0].Rows[0].Cells[0].GetStyle()
+    if style.Alignment.WrapText || style.Fill.FgColor != "" || !style.Font.Bold {
+        t.Errorf("default: wrap %v, fill %q", style.Alignment.WrapText, style.Fill.FgColor)
+    }
+    if err := tpl.RenderTemplate(map[string]string{"Name": "a"}); err != nil {
+        t.Fatal(err)
+    }
+    before := fmt.Sprintf("%+v", *tpl.result.Sheets[0].Rows[0].Cells[0].GetStyle())
+    if err := tpl.WriteToHTML(ioutil.Discard); err != nil {
+        t.Fatal(err)
+    }
+    // Правки стилей для HTML/PDF не меняют результат
+    if after := fmt.Sprintf("%+v", *tpl.result.Sheets[0].Rows[0].Cells[0].GetStyle()); after != before {
+        t.Errorf("result style changed:\n%s\n%s", before, after)
+    }
+
+    tpl, err = OpenTemplate(filename, WithWrapText(), WithWhiteFill())
+    if err != nil {
+        t.Fatal(err)
+    }
+    style = tpl.template.Sheets[0].Rows[0].Cells[0].GetStyle()
+    if !style.Alignment.WrapText || style.Fill.FgColor != "FFFFFFFF" {
+        t.Errorf("options: wrap %v, fill %q", style.Alignment.WrapText, style.Fill.FgColor)
+    }
+}